@@ -1,3 +1,10 @@
 module words
 
 go 1.22
+
+require (
+	github.com/fsnotify/fsnotify v1.8.0
+	golang.org/x/text v0.21.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -1,47 +1,370 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"io/fs"
 	"log"
+	"log/slog"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
 )
 
 //go:embed web/*
 var webFS embed.FS
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const shutdownTimeout = 10 * time.Second
+
+// defaultAccents are the accents accepted when WORDS_RAIN_ACCENTS is unset.
+var defaultAccents = []string{"en-US", "en-GB"}
+
+// defaultWordPattern accepts words made of letters, hyphens and apostrophes.
+// WORDS_RAIN_WORD_PATTERN replaces it.
+var defaultWordPattern = regexp.MustCompile(`^[\p{L}'-]+$`)
+
+// accentLabels holds human-readable names for well-known accents.
+var accentLabels = map[string]string{
+	"en-US": "American English (en-US)",
+	"en-GB": "British English (en-GB)",
+	"en-AU": "Australian English (en-AU)",
+	"en-CA": "Canadian English (en-CA)",
+	"en-IE": "Irish English (en-IE)",
+	"en-IN": "Indian English (en-IN)",
+	"en-NZ": "New Zealand English (en-NZ)",
+	"en-ZA": "South African English (en-ZA)",
+}
+
+// canonicalAccent parses a BCP 47 language tag and returns it in canonical
+// form, so that en-us becomes en-US.
+func canonicalAccent(accent string) (string, error) {
+	tag, err := language.Parse(accent)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a language tag", accent)
+	}
+	return tag.String(), nil
+}
+
 type server struct {
-	wordbooksDir string
-	staticFS     fs.FS
-	configPath   string
+	// wordbooksDir is the first of wordbooksDirs, where new wordbooks are
+	// written; changes to an existing wordbook go to the directory holding it.
+	wordbooksDir  string
+	wordbooksDirs []string
+	// wordbooksMu serializes changes to the wordbook files.
+	wordbooksMu sync.Mutex
+	// wordbooks holds the wordbook files: wordbooksDirs layered in order,
+	// or the archive given by --wordbooks-zip.
+	wordbooks fs.FS
+	// readOnly rejects changes to wordbooks, which a zip archive cannot
+	// take.
+	readOnly bool
+	// stdin is set when --stdin serves the in-memory, read-only wordbook
+	// stdinWordbook.
+	stdin      bool
+	staticFS   fs.FS
+	configPath string
+	// effectiveConfig is the config resolved at startup from flags, the
+	// environment and the config file.
+	effectiveConfig appConfig
+	// importMaxBytes caps the size of uploaded import files.
+	importMaxBytes int64
+	// fetchClient downloads wordbooks for /api/wordbooks/fetch; nil uses
+	// newFetchClient, which refuses internal addresses.
+	fetchClient *http.Client
+	// settingsLimiter throttles writes to the settings endpoints.
+	settingsLimiter *tokenBucket
+	// ttsCommand is the offline speech command, split into arguments, with
+	// {word} and {accent} placeholders. Empty disables /api/tts.
+	ttsCommand []string
+	// fieldSep separates a word from its definition on a wordbook line.
+	fieldSep string
+	// dryRun suppresses config writes while handlers still report the
+	// would-be result.
+	dryRun bool
+
+	// configMu serializes read-modify-write cycles on the config file.
+	configMu sync.Mutex
+	// historyMu serializes appends to the history file.
+	historyMu sync.Mutex
+	// metrics is nil unless --metrics is set.
+	metrics *metrics
+	// words caches parsed wordbooks by file name, see getWords.
+	words  sync.Map
+	events eventBroker
+	stats  statsCache
+}
+
+// historyEntry records words added to a wordbook, one per line of the
+// history file.
+type historyEntry struct {
+	Time     time.Time `json:"time"`
+	Wordbook string    `json:"wordbook"`
+	Count    int       `json:"count"`
+}
+
+type historyResponse struct {
+	Entries []historyEntry `json:"entries"`
+}
+
+type configResponse struct {
+	Path   string         `json:"path"`
+	Config map[string]any `json:"config"`
+}
+
+type wordbookCountResponse struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
 }
 
 type wordbookListResponse struct {
+	Wordbooks []string       `json:"wordbooks"`
+	Books     []wordbookInfo `json:"books"`
+}
+
+type wordbookInfo struct {
+	Name        string   `json:"name"`
+	Count       int      `json:"count"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// Directives holds the "#! key: value" lines of the wordbook file.
+	Directives map[string]string `json:"directives,omitempty"`
+}
+
+// wordbookMeta is the optional metadata stored next to a wordbook in
+// name.meta.json.
+type wordbookMeta struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+type wordbookMetaResponse struct {
+	wordbookMeta
+	Directives map[string]string `json:"directives"`
+}
+
+type lintResponse struct {
+	Name               string          `json:"name"`
+	Duplicates         []lintDuplicate `json:"duplicates"`
+	TrailingWhitespace []int           `json:"trailingWhitespace"`
+	NonASCII           []lintWord      `json:"nonAscii"`
+	EmptyLines         []int           `json:"emptyLines"`
+}
+
+type lintDuplicate struct {
+	Word  string `json:"word"`
+	Lines []int  `json:"lines"`
+}
+
+type lintWord struct {
+	Word string `json:"word"`
+	Line int    `json:"line"`
+}
+
+type completeResponse struct {
+	Words []string `json:"words"`
+}
+
+const defaultCompleteLimit = 10
+
+type wordbookConflict struct {
+	Name      string   `json:"name"`
 	Wordbooks []string `json:"wordbooks"`
 }
 
+type conflictsResponse struct {
+	Conflicts []wordbookConflict `json:"conflicts"`
+}
+
+type containsResponse struct {
+	Contains bool `json:"contains"`
+}
+
+type rankedWord struct {
+	Word string `json:"word"`
+	Rank *int   `json:"rank"`
+}
+
+type wordbookRankedResponse struct {
+	Name  string       `json:"name"`
+	Words []rankedWord `json:"words"`
+}
+
 type wordbookWordsResponse struct {
 	Name  string   `json:"name"`
 	Words []string `json:"words"`
+	Total int      `json:"total"`
+	// Accent is the effective accent of word-serving endpoints, see
+	// requestAccent.
+	Accent string `json:"accent,omitempty"`
+}
+
+const defaultWordsPageLimit = 500
+
+type searchResponse struct {
+	Query     string   `json:"query"`
+	Wordbooks []string `json:"wordbooks"`
+}
+
+type statsResponse struct {
+	Wordbooks    int     `json:"wordbooks"`
+	UniqueWords  int     `json:"uniqueWords"`
+	AverageWords float64 `json:"averageWords"`
+	LongestWord  string  `json:"longestWord"`
+	ShortestWord string  `json:"shortestWord"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+type wordbookCreateRequest struct {
+	Name  string   `json:"name"`
+	Words []string `json:"words"`
+}
+
+type wordbookFetchRequest struct {
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+type invalidWord struct {
+	Line int    `json:"line"`
+	Word string `json:"word"`
+}
+
+type invalidWordsResponse struct {
+	Error   string        `json:"error"`
+	Pattern string        `json:"pattern"`
+	Invalid []invalidWord `json:"invalid"`
+}
+
+type wordbookAppendRequest struct {
+	Words []string `json:"words"`
+}
+
+type wordbookNormalizeResponse struct {
+	Name   string `json:"name"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+}
+
+type wordbookAppendResponse struct {
+	Name    string `json:"name"`
+	Added   int    `json:"added"`
+	Skipped int    `json:"skipped"`
+}
+
+type wordbookRemoveRequest struct {
+	Words []string `json:"words"`
+}
+
+type wordbookRemoveResponse struct {
+	Name     string `json:"name"`
+	Removed  int    `json:"removed"`
+	NotFound int    `json:"notFound"`
+}
+
+type wordEntry struct {
+	Word       string `json:"word"`
+	Definition string `json:"definition"`
+}
+
+type wordbookEntriesResponse struct {
+	Name  string      `json:"name"`
+	Words []wordEntry `json:"words"`
+}
+
+type randomWordResponse struct {
+	Word   string `json:"word"`
+	Accent string `json:"accent"`
+}
+
+type randomWordbookResponse struct {
+	Name string `json:"name"`
+}
+
+type randomWordsResponse struct {
+	Words  []string `json:"words"`
+	Accent string   `json:"accent"`
+}
+
+type wordbookProgress struct {
+	Index     int  `json:"index"`
+	Completed bool `json:"completed"`
+}
+
+type wordbookRenameRequest struct {
+	NewName string `json:"newName"`
+}
+
+type wordbookRenameResponse struct {
+	Name         string `json:"name"`
+	PreviousName string `json:"previousName"`
 }
 
 type settingsResponse struct {
-	Accent   string `json:"accent"`
-	Wordbook string `json:"wordbook"`
+	Accent      string  `json:"accent"`
+	Wordbook    string  `json:"wordbook"`
+	Speed       float64 `json:"speed,omitempty"`
+	SessionSize int     `json:"sessionSize,omitempty"`
+	Theme       string  `json:"theme"`
+}
+
+type accentListResponse struct {
+	Accents []accentInfo `json:"accents"`
+}
+
+type accentInfo struct {
+	Code  string `json:"code"`
+	Label string `json:"label"`
 }
 
 type settingsAccentRequest struct {
@@ -50,73 +373,330 @@ type settingsAccentRequest struct {
 
 type settingsWordbookRequest struct {
 	Wordbook string `json:"wordbook"`
+	// Index selects a wordbook by its position in the sorted listing
+	// instead of by name.
+	Index *int `json:"index"`
+}
+
+type settingsSpeedRequest struct {
+	Speed float64 `json:"speed"`
+}
+
+type settingsSessionSizeRequest struct {
+	SessionSize int `json:"sessionSize"`
 }
 
+type settingsThemeRequest struct {
+	Theme string `json:"theme"`
+}
+
+// themes lists the accepted WORDS_RAIN_THEME values; "system" follows the
+// browser's color scheme and is the default.
+var themes = []string{"light", "dark", "system"}
+
 func main() {
-	var wordbooksDir string
+	var wordbooksDirs stringsFlag
+	var wordbooksZip string
 	var host string
 	var port int
 	var openBrowser bool
+	var tlsCert string
+	var tlsKey string
+	var logFormat string
+	var corsOrigin string
+	var authUser string
+	var authPass string
+	var importMaxBytes int64
+	var maxBodyBytes int64
+	var configFlag string
+	var settingsRate float64
+	var dryRun bool
+	var webDir string
+	var unixSocket string
+	var showVersion bool
+	var ttsCommand string
+	var quiet bool
+	var basePath string
+	var warmup bool
+	var apiOnly bool
+	var staticMaxAge time.Duration
+	var metricsEnabled bool
+	var useStdin bool
+	var readHeaderTimeout time.Duration
+	var readTimeout time.Duration
+	var writeTimeout time.Duration
+	var idleTimeout time.Duration
 
-	flag.StringVar(&wordbooksDir, "wordbooks-dir", "", "Directory containing .txt wordbook files")
+	flag.Var(&wordbooksDirs, "wordbooks-dir", "Directory containing .txt wordbook files; repeat or comma-separate for several")
+	flag.BoolVar(&useStdin, "stdin", false, "Serve the words piped to stdin as an in-memory wordbook named \"stdin\"")
+	flag.StringVar(&wordbooksZip, "wordbooks-zip", "", "Zip archive of .txt wordbook files, served read-only instead of --wordbooks-dir")
 	flag.StringVar(&host, "host", "127.0.0.1", "HTTP host")
 	flag.IntVar(&port, "port", 8080, "HTTP port")
 	flag.BoolVar(&openBrowser, "open-browser", false, "Open browser on startup")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file; serves HTTPS together with --tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file; serves HTTPS together with --tls-cert")
+	flag.StringVar(&corsOrigin, "cors-origin", "", "Origin allowed to call the API cross-origin, e.g. http://localhost:5173")
+	flag.StringVar(&authUser, "auth-user", "", "Require HTTP Basic Auth with this user name; set together with --auth-pass")
+	flag.StringVar(&authPass, "auth-pass", "", "Password for --auth-user")
+	flag.Int64Var(&importMaxBytes, "import-max-bytes", 5<<20, "Maximum size in bytes of an uploaded import file")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", 1<<20, "Maximum size in bytes of an API request body")
+	flag.Float64Var(&settingsRate, "settings-rate", 10, "Maximum settings writes per second (0 disables the limit)")
+	flag.BoolVar(&dryRun, "dry-run", false, "Do not write settings changes to the config file")
+	flag.StringVar(&webDir, "web-dir", "", "Directory of web assets overriding the embedded UI files")
+	flag.StringVar(&unixSocket, "unix-socket", "", "Serve on this Unix domain socket instead of --host/--port")
+	flag.StringVar(&ttsCommand, "tts-command", "", "Offline TTS command writing WAV to stdout, e.g. \"espeak-ng -v {accent} --stdout {word}\"; enables /api/tts")
+	flag.BoolVar(&showVersion, "version", false, "Print version information and exit")
+	flag.StringVar(&basePath, "base-path", "", "URL path prefix to serve the app under, e.g. /words-rain")
+	flag.DurationVar(&staticMaxAge, "static-max-age", time.Hour, "How long browsers may cache the web UI's scripts and styles")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum time to read a request's headers")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "Maximum time to read a whole request, including the body")
+	flag.DurationVar(&writeTimeout, "write-timeout", time.Minute, "Maximum time to write a response; /api/events streams are exempt")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "How long an idle keep-alive connection stays open")
+	flag.BoolVar(&apiOnly, "api-only", false, "Serve only the /api/ routes, without the embedded web UI")
+	flag.BoolVar(&metricsEnabled, "metrics", false, "Serve Prometheus metrics at /metrics")
+	flag.BoolVar(&warmup, "warmup", false, "Read and cache every wordbook in the background at startup")
+	flag.BoolVar(&quiet, "quiet", false, "Log nothing but fatal errors")
+	flag.StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	flag.StringVar(&configFlag, "config", "", "Config file path (default ~/.config/words-rain/config.env)")
 	flag.Parse()
 
-	if len(os.Args) == 1 {
-		cfg, cfgPath, err := loadDefaultConfig()
+	if showVersion || flag.Arg(0) == "version" {
+		fmt.Printf("words-rain %s (%s)\n", version, runtime.Version())
+		return
+	}
+
+	switch logFormat {
+	case "text":
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		log.Fatalf("invalid --log-format %q: expected text or json", logFormat)
+	}
+
+	configPath := configFlag
+	if configPath == "" {
+		p, err := defaultConfigPath()
 		if err != nil {
-			log.Fatalf("failed to load default config %q: %v", cfgPath, err)
-		}
-		if wordbooksDir == "" {
-			wordbooksDir = cfg.WordbooksDir
-		}
-		if host == "127.0.0.1" && cfg.Host != "" {
-			host = cfg.Host
+			log.Fatalf("failed to resolve config path: %v", err)
 		}
-		if port == 8080 && cfg.Port != 0 {
-			port = cfg.Port
+		configPath = p
+	}
+
+	var cfg appConfig
+	if len(os.Args) == 1 || (flag.NFlag() == 1 && configFlag != "") {
+		fileCfg, err := loadConfigOptional(configPath)
+		if err != nil {
+			log.Fatalf("failed to load default config %q: %v", configPath, err)
 		}
+		cfg = fileCfg
+	}
+	if err := applyEnvOverrides(&cfg); err != nil {
+		log.Fatalf("invalid environment: %v", err)
+	}
+	if cfg.Locale != "" {
+		setWordLocale(language.Make(cfg.Locale))
+	}
+
+	// Precedence is flags > environment > config file > defaults.
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if !setFlags["wordbooks-dir"] && cfg.WordbooksDir != "" && wordbooksZip == "" {
+		wordbooksDirs.Set(cfg.WordbooksDir)
+	}
+	if !setFlags["host"] && cfg.Host != "" {
+		host = cfg.Host
+	}
+	if !setFlags["port"] && cfg.Port != 0 {
+		port = cfg.Port
+	}
+	if !setFlags["open-browser"] {
 		openBrowser = cfg.OpenBrowser
 	}
+	if !setFlags["tls-cert"] && cfg.TLSCert != "" {
+		tlsCert = cfg.TLSCert
+	}
+	if !setFlags["tls-key"] && cfg.TLSKey != "" {
+		tlsKey = cfg.TLSKey
+	}
+	if !setFlags["cors-origin"] && cfg.CORSOrigin != "" {
+		corsOrigin = cfg.CORSOrigin
+	}
+	if !setFlags["auth-user"] && cfg.AuthUser != "" {
+		authUser = cfg.AuthUser
+	}
+	if !setFlags["auth-pass"] && cfg.AuthPass != "" {
+		authPass = cfg.AuthPass
+	}
+
+	if unixSocket == "" {
+		if err := validateListenAddr(host, port); err != nil {
+			log.Fatalf("invalid listen address: %v", err)
+		}
+	}
 
-	if strings.TrimSpace(wordbooksDir) == "" {
-		log.Fatal("missing required parameter: --wordbooks-dir (or WORDS_RAIN_WORDBOOKS_DIR in default config)")
+	var wordbooks fs.FS
+	if wordbooksZip != "" {
+		if setFlags["wordbooks-dir"] {
+			log.Fatal("--wordbooks-dir and --wordbooks-zip are mutually exclusive")
+		}
+		zr, err := zip.OpenReader(wordbooksZip)
+		if err != nil {
+			log.Fatalf("invalid wordbooks archive: %v", err)
+		}
+		defer zr.Close()
+		wordbooks = zr
+	} else {
+		if len(wordbooksDirs) == 0 && !useStdin {
+			log.Fatal("missing required parameter: --wordbooks-dir (or WORDS_RAIN_WORDBOOKS_DIR in the environment or default config)")
+		}
+		// Earlier directories take precedence, so layer from the last.
+		for i := len(wordbooksDirs) - 1; i >= 0; i-- {
+			dir := wordbooksDirs[i]
+			if err := ensureDirExists(dir); err != nil {
+				log.Fatalf("invalid wordbooks directory: %v", err)
+			}
+			if wordbooks == nil {
+				wordbooks = os.DirFS(dir)
+			} else {
+				wordbooks = layeredFS{upper: os.DirFS(dir), lower: wordbooks}
+			}
+		}
+	}
+	if useStdin {
+		stdinFS, err := readStdinWordbook(os.Stdin)
+		if err != nil {
+			log.Fatalf("invalid --stdin: %v", err)
+		}
+		if wordbooks == nil {
+			wordbooks = stdinFS
+		} else {
+			wordbooks = layeredFS{upper: stdinFS, lower: wordbooks}
+		}
+	}
+	if len(cfg.AllowedWordbooks) > 0 {
+		wordbooks = newAllowedFS(wordbooks, cfg.AllowedWordbooks)
+	}
+	var wordbooksDir string
+	if len(wordbooksDirs) > 0 {
+		wordbooksDir = wordbooksDirs[0]
 	}
 
-	if err := ensureDirExists(wordbooksDir); err != nil {
-		log.Fatalf("invalid wordbooks directory: %v", err)
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("--tls-cert and --tls-key (or WORDS_RAIN_TLS_CERT and WORDS_RAIN_TLS_KEY) must be set together")
+	}
+	if (authUser == "") != (authPass == "") {
+		log.Fatal("--auth-user and --auth-pass (or WORDS_RAIN_AUTH_USER and WORDS_RAIN_AUTH_PASS) must be set together")
+	}
+	scheme := "http"
+	if tlsCert != "" {
+		scheme = "https"
 	}
 
 	staticFS, err := fs.Sub(webFS, "web")
 	if err != nil {
 		log.Fatalf("failed to load static files: %v", err)
 	}
-
-	configPath, err := defaultConfigPath()
-	if err != nil {
-		log.Fatalf("failed to resolve config path: %v", err)
+	if webDir != "" {
+		if err := ensureDirExists(webDir); err != nil {
+			log.Fatalf("invalid web directory: %v", err)
+		}
+		staticFS = layeredFS{upper: os.DirFS(webDir), lower: staticFS}
 	}
 
+	effective := cfg
+	effective.Host = host
+	effective.Port = port
+	effective.WordbooksDir = strings.Join(wordbooksDirs, ",")
+	effective.OpenBrowser = openBrowser
+	effective.TLSCert = tlsCert
+	effective.TLSKey = tlsKey
+	effective.CORSOrigin = corsOrigin
+	effective.AuthUser = authUser
+	effective.AuthPass = authPass
+
 	s := &server{
-		wordbooksDir: wordbooksDir,
-		staticFS:     staticFS,
-		configPath:   configPath,
+		effectiveConfig: effective,
+		wordbooksDir:    wordbooksDir,
+		wordbooksDirs:   wordbooksDirs,
+		wordbooks:       wordbooks,
+		readOnly:        wordbooksZip != "" || len(wordbooksDirs) == 0,
+		stdin:           useStdin,
+		staticFS:        staticFS,
+		configPath:      configPath,
+		importMaxBytes:  importMaxBytes,
+		settingsLimiter: newTokenBucket(settingsRate),
+		dryRun:          dryRun,
+		ttsCommand:      strings.Fields(ttsCommand),
+		fieldSep:        fieldSeparator(cfg),
+	}
+
+	if metricsEnabled {
+		s.metrics = newMetrics()
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/wordbooks", s.handleWordbooks)
-	mux.HandleFunc("/api/wordbooks/", s.handleWordbookWords)
+	mux.HandleFunc("/api/wordbooks/", s.handleWordbook)
+	mux.HandleFunc("/api/wordbooks/import", s.handleImportCSV)
+	mux.HandleFunc("/api/wordbooks/fetch", s.handleFetchWordbook)
+	mux.HandleFunc("/api/wordbooks/merged", s.handleMergedWordbooks)
+	mux.HandleFunc("/api/wordbooks/conflicts", s.handleConflicts)
+	mux.HandleFunc("/api/wordbooks/random", s.handleRandomWordbook)
+	mux.HandleFunc("/api/export/all", s.handleExportAll)
+	mux.HandleFunc("/api/words", s.handleSelectedWords)
+	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/history", s.handleHistory)
+	if len(s.ttsCommand) > 0 {
+		mux.HandleFunc("/api/tts", s.handleTTS)
+	}
+	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("/api/healthz", s.handleHealthz)
+	mux.HandleFunc("/api/accents", s.handleAccents)
 	mux.HandleFunc("/api/settings", s.handleSettings)
-	mux.HandleFunc("/api/settings/accent", s.handleSettingsAccent)
-	mux.HandleFunc("/api/settings/wordbook", s.handleSettingsWordbook)
-	mux.Handle("/", http.FileServer(http.FS(staticFS)))
-
-	addr := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("serving on http://%s", addr)
-	if openBrowser {
-		url := fmt.Sprintf("http://%s:%d", browserHost(host), port)
+	mux.HandleFunc("/api/config", s.handleConfig)
+	mux.Handle("/api/settings/accent", s.limitWrites(http.HandlerFunc(s.handleSettingsAccent)))
+	mux.Handle("/api/settings/wordbook", s.limitWrites(http.HandlerFunc(s.handleSettingsWordbook)))
+	mux.Handle("/api/settings/wordbook/next", s.limitWrites(s.stepWordbook(1)))
+	mux.Handle("/api/settings/wordbook/previous", s.limitWrites(s.stepWordbook(-1)))
+	mux.Handle("/api/settings/speed", s.limitWrites(http.HandlerFunc(s.handleSettingsSpeed)))
+	mux.Handle("/api/settings/session-size", s.limitWrites(http.HandlerFunc(s.handleSettingsSessionSize)))
+	mux.Handle("/api/settings/theme", s.limitWrites(http.HandlerFunc(s.handleSettingsTheme)))
+	if s.metrics != nil {
+		mux.HandleFunc("/metrics", s.metrics.handle)
+	}
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	if !apiOnly {
+		mux.Handle("/", withCacheControl(staticMaxAge, withIndexPage(basePath, staticFS, http.FileServer(http.FS(staticFS)))))
+	}
+
+	// Fatal errors are reported even with --quiet.
+	fatal := log.New(os.Stderr, "", log.LstdFlags)
+	if quiet {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+		log.SetOutput(io.Discard)
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	var ln net.Listener
+	if unixSocket != "" {
+		ln, err = listenUnix(unixSocket)
+		if err != nil {
+			fatal.Fatalf("failed to listen on %s: %v", unixSocket, err)
+		}
+		log.Printf("serving on unix:%s", unixSocket)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			fatal.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+		log.Printf("serving on %s://%s", scheme, addr)
+	}
+	if openBrowser && unixSocket == "" && !apiOnly {
+		url := browserURL(scheme, host, port, basePath)
 		go func() {
 			time.Sleep(250 * time.Millisecond)
 			if err := openBrowserURL(url); err != nil {
@@ -124,234 +704,4181 @@ func main() {
 			}
 		}()
 	}
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("server failed: %v", err)
-	}
-}
 
-func ensureDirExists(path string) error {
-	info, err := os.Stat(path)
-	if err != nil {
-		return err
+	var handler http.Handler = withGzip(withBodyLimit(maxBodyBytes, mux))
+	if s.metrics != nil {
+		handler = s.metrics.count(mux, handler)
 	}
-	if !info.IsDir() {
-		return fmt.Errorf("%s is not a directory", path)
+	if authUser != "" {
+		handler = withBasicAuth(authUser, authPass, handler)
 	}
-	return nil
-}
-
-func (s *server) handleWordbooks(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+	if corsOrigin != "" {
+		handler = withCORS(corsOrigin, handler)
 	}
-
-	books, err := listWordbooks(s.wordbooksDir)
-	if err != nil {
-		http.Error(w, "failed to list wordbooks", http.StatusInternalServerError)
-		return
+	if basePath != "" {
+		root := http.NewServeMux()
+		root.Handle(basePath+"/", http.StripPrefix(basePath, handler))
+		root.Handle(basePath, http.RedirectHandler(basePath+"/", http.StatusMovedPermanently))
+		handler = root
 	}
 
-	writeJSON(w, wordbookListResponse{Wordbooks: books})
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           withRecovery(withRequestID(withLogging(handler))),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	srv.RegisterOnShutdown(s.events.close)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A count of -1 means the wordbooks could not be listed.
+	books, listErr := listWordbooks(s.wordbooks)
+	wordbookCount := len(books)
+	if listErr != nil {
+		wordbookCount = -1
+	}
+	listenAddr := addr
+	if unixSocket != "" {
+		listenAddr = "unix:" + unixSocket
+	}
+	slog.Info("startup",
+		"wordbooks_dirs", strings.Join(wordbooksDirs, ","),
+		"wordbooks_zip", wordbooksZip,
+		"stdin", useStdin,
+		"wordbooks", wordbookCount,
+		"config", configPath,
+		"addr", listenAddr,
+		"open_browser", openBrowser && unixSocket == "" && !apiOnly,
+		"read_only", s.readOnly,
+	)
+	for _, shadow := range shadowedWordbooks(s.wordbooksDirs) {
+		log.Printf("wordbook %q in %s is shadowed by %s", shadow.Name, shadow.Dir, shadow.By)
+	}
+	for _, c := range wordbookConflicts(books) {
+		log.Printf("wordbooks share the base name %q: %s", c.Name, strings.Join(c.Wordbooks, ", "))
+	}
+	if warmup {
+		go s.warmup()
+	}
+	if !s.readOnly {
+		go func() {
+			if err := watchWordbooks(ctx, wordbooksDirs, s.wordbooksChanged); err != nil {
+				log.Printf("not watching wordbooks directory: %v", err)
+			}
+		}()
+	}
+	if err := serve(ctx, srv, ln, tlsCert, tlsKey); err != nil {
+		fatal.Fatalf("server failed: %v", err)
+	}
 }
 
-func (s *server) handleWordbookWords(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
+// serve runs srv on ln until it fails or ctx is cancelled, in which case
+// in-flight requests are given shutdownTimeout to complete. HTTPS is used
+// when a certificate and key are given.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, tlsCert, tlsKey string) error {
+	errCh := make(chan error, 1)
+	go func() {
+		if tlsCert != "" {
+			errCh <- srv.ServeTLS(ln, tlsCert, tlsKey)
+			return
+		}
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
 	}
 
-	rawName := strings.TrimPrefix(r.URL.Path, "/api/wordbooks/")
-	name, err := url.PathUnescape(rawName)
-	if err != nil {
-		http.Error(w, "invalid wordbook name", http.StatusBadRequest)
-		return
+	log.Print("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
 	}
-	name = strings.TrimSpace(name)
-	if name == "" || strings.Contains(name, "/") || strings.Contains(name, "\\") {
-		http.Error(w, "invalid wordbook name", http.StatusBadRequest)
-		return
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
+}
 
-	words, err := readWordbook(filepath.Join(s.wordbooksDir, name+".txt"))
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "wordbook not found", http.StatusNotFound)
-			return
+// withLogging logs the method, path, status and duration of every request.
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
 		}
-		http.Error(w, "failed to read wordbook", http.StatusInternalServerError)
-		return
-	}
+		slog.Info("request",
+			"request_id", requestID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.status,
+			"duration", time.Since(start),
+		)
+	})
+}
 
-	writeJSON(w, wordbookWordsResponse{Name: name, Words: words})
+// withRecovery turns a panicking handler into a 500 response instead of a
+// dropped connection, logging the panic with its stack trace. A panic after
+// the response has started aborts the connection instead, so the client
+// sees a broken response rather than a truncated 200.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			slog.Error("panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"error", err,
+				"stack", string(debug.Stack()),
+			)
+			if rw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Encoding")
+			writeJSONError(w, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rw, r)
+	})
 }
 
-func (s *server) handleSettings(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+type requestIDKey struct{}
 
-	cfg, err := loadConfigOptional(s.configPath)
-	if err != nil {
-		http.Error(w, "failed to read settings", http.StatusInternalServerError)
-		return
-	}
+// maxRequestIDLen bounds client-supplied request IDs so they cannot bloat
+// the logs.
+const maxRequestIDLen = 128
 
-	accent := strings.TrimSpace(cfg.Accent)
-	if accent == "" {
-		accent = "en-US"
-	}
-	writeJSON(w, settingsResponse{
-		Accent:   accent,
-		Wordbook: strings.TrimSpace(cfg.Wordbook),
+// withRequestID tags each request with the incoming X-Request-ID header, or
+// a fresh random UUID, and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if id == "" || len(id) > maxRequestIDLen {
+			id = newUUID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
 	})
 }
 
-func (s *server) handleSettingsAccent(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// requestID returns the request ID stored in ctx by withRequestID, or an
+// empty string.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
 
-	var req settingsAccentRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
-		return
-	}
-	accent := strings.TrimSpace(req.Accent)
-	if accent != "en-US" && accent != "en-GB" {
-		http.Error(w, "invalid accent", http.StatusBadRequest)
-		return
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
 	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
 
-	cfg, err := loadConfigOptional(s.configPath)
-	if err != nil {
-		http.Error(w, "failed to read settings", http.StatusInternalServerError)
-		return
+// withCacheControl lets browsers cache static assets for maxAge when they
+// are requested with the content version that withIndexPage adds, and has
+// them revalidate the page and unversioned assets on every load. Errors are
+// not marked cacheable.
+func withCacheControl(maxAge time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := "no-cache"
+		if r.URL.Query().Get("v") != "" && r.URL.Path != "/" && !strings.HasSuffix(r.URL.Path, ".html") {
+			value = fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds()))
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: value}, r)
+	})
+}
+
+// cacheControlWriter sets Cache-Control to value on successful responses.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (c *cacheControlWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if status == http.StatusOK || status == http.StatusNotModified {
+			c.Header().Set("Cache-Control", c.value)
+		}
 	}
-	if cfg.Host == "" {
-		cfg.Host = "127.0.0.1"
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheControlWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
 	}
-	if cfg.Port == 0 {
-		cfg.Port = 8080
+	return c.ResponseWriter.Write(b)
+}
+
+// pageAssets are the files index.html refers to, which withIndexPage
+// versions.
+var pageAssets = []string{"styles.css", "app.js"}
+
+// withIndexPage serves index.html with each of pageAssets referenced by a
+// hash of its content, as in app.js?v=1a2b3c4d, so that browsers fetch
+// changed assets at once however long they cache them. Unless basePath is
+// empty, it also adds a <base> element pointing at basePath, so that the
+// page's relative asset and API URLs resolve under the prefix. Other
+// requests go to next.
+func withIndexPage(basePath string, staticFS fs.FS, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		page, err := fs.ReadFile(staticFS, "index.html")
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, asset := range pageAssets {
+			data, err := fs.ReadFile(staticFS, asset)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(data)
+			versioned := fmt.Sprintf(`"%s?v=%s"`, asset, hex.EncodeToString(sum[:4]))
+			page = bytes.ReplaceAll(page, []byte(`"`+asset+`"`), []byte(versioned))
+		}
+		if basePath != "" {
+			base := fmt.Sprintf(`<head>%s    <base href="%s/" />`, "\n", html.EscapeString(basePath))
+			page = bytes.Replace(page, []byte("<head>"), []byte(base), 1)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+}
+
+// withCORS allows origin to call the /api/ routes from a browser and answers
+// their preflight requests.
+func withCORS(origin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withBasicAuth requires HTTP Basic credentials matching user and pass,
+// answering 401 otherwise. Both are compared as SHA-256 digests in constant
+// time so that neither their contents nor their lengths leak.
+func withBasicAuth(user, pass string, next http.Handler) http.Handler {
+	wantUser := sha256.Sum256([]byte(user))
+	wantPass := sha256.Sum256([]byte(pass))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		gotUser := sha256.Sum256([]byte(u))
+		gotPass := sha256.Sum256([]byte(p))
+		userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+		passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass[:])
+		if !ok || userOK&passOK != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="words-rain", charset="UTF-8"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowMethods reports whether the request uses one of methods, answering
+// 405 with an Allow header otherwise.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+	methodNotAllowed(w, methods...)
+	return false
+}
+
+// methodNotAllowed answers 405, listing the permitted methods in the Allow
+// header.
+func methodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// withBodyLimit caps API request bodies at limit bytes. The CSV import
+// endpoint applies its own, larger limit.
+func withBodyLimit(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/api/wordbooks/import" {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeJSONBody decodes the request body into v. On failure it answers 413
+// for oversized bodies or 400 otherwise, and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return false
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
+
+// limitWrites rejects mutating requests with 429 once the settings write
+// rate is exceeded. Reads pass through unthrottled.
+func (s *server) limitWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.settingsLimiter.allow() {
+			writeJSONError(w, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenBucket is a token-bucket rate limiter refilled at rate tokens per
+// second with a burst of max(rate, 1). A nil bucket allows everything.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(rate, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// gzipMinSize is the smallest response body worth compressing.
+const gzipMinSize = 1024
+
+// withGzip compresses /api/ responses for clients that accept gzip. Bodies
+// smaller than gzipMinSize and streamed responses are sent uncompressed.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer func() {
+			if err := recover(); err != nil {
+				// Leave the response to withRecovery: drop the buffered
+				// start of the body, and don't Close, which would send it
+				// or end a started gzip stream as if it were complete.
+				gw.buf = nil
+				panic(err)
+			}
+			gw.Close()
+		}()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response and decides whether to
+// compress once gzipMinSize bytes are written, the handler flushes, or the
+// response completes.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(b)
+		}
+		return g.ResponseWriter.Write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the headers and any buffered bytes, compressing the rest of
+// the response when compress is true.
+func (g *gzipResponseWriter) decide(compress bool) error {
+	g.decided = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	// Archives are already compressed.
+	if g.Header().Get("Content-Encoding") != "" || g.Header().Get("Content-Type") == "application/zip" {
+		compress = false
+	}
+	if compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		_, err := g.gz.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Close() error {
+	if !g.decided {
+		return g.decide(false)
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
+
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// responseWriter records the status code written by a handler.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// listenUnix listens on a Unix domain socket at path, first removing a stale
+// socket left behind by a previous run. The socket file is removed again
+// when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// validateListenAddr checks that port is a usable TCP port and that host is
+// an IP address or a syntactically valid host name. An empty host listens on
+// all interfaces.
+func validateListenAddr(host string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d out of range 1-65535", port)
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("host %q is too long", host)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !hostLabelPattern.MatchString(label) {
+			return fmt.Errorf("host %q is not a valid IP address or host name", host)
+		}
+	}
+	return nil
+}
+
+// hostLabelPattern matches a single DNS label.
+var hostLabelPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// layeredFS serves files from upper, falling back to lower for any file
+// upper does not have.
+type layeredFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	f, err := l.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return l.lower.Open(name)
+}
+
+// ReadDir merges the directory from both layers, preferring upper's entry
+// when a name is in both.
+func (l layeredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(l.upper, name)
+	if upperErr != nil && !errors.Is(upperErr, fs.ErrNotExist) {
+		return nil, upperErr
+	}
+	lower, lowerErr := fs.ReadDir(l.lower, name)
+	if lowerErr != nil && !errors.Is(lowerErr, fs.ErrNotExist) {
+		return nil, lowerErr
+	}
+	if upperErr != nil && lowerErr != nil {
+		return nil, upperErr
+	}
+
+	entries := upper
+	seen := make(map[string]bool, len(upper))
+	for _, entry := range upper {
+		seen[entry.Name()] = true
+	}
+	for _, entry := range lower {
+		if !seen[entry.Name()] {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// allowedFS hides the files of every wordbook not in allowed, so that they
+// are absent to all handlers. Other files and directories pass through.
+type allowedFS struct {
+	fsys    fs.FS
+	allowed map[string]bool
+}
+
+func newAllowedFS(fsys fs.FS, names []string) allowedFS {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return allowedFS{fsys: fsys, allowed: allowed}
+}
+
+// wordbookFileSuffixes are the suffixes of the files belonging to a
+// wordbook, longest first.
+var wordbookFileSuffixes = []string{".freq.txt.gz", ".meta.json", ".freq.txt", ".txt.gz", ".txt"}
+
+// visible reports whether the file at name may be seen.
+func (a allowedFS) visible(name string) bool {
+	lower := strings.ToLower(name)
+	for _, suffix := range wordbookFileSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return a.allowed[strings.TrimSpace(name[:len(name)-len(suffix)])]
+		}
+	}
+	return true
+}
+
+func (a allowedFS) Open(name string) (fs.File, error) {
+	if !a.visible(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return a.fsys.Open(name)
+}
+
+func (a allowedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(a.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	visible := entries[:0]
+	for _, entry := range entries {
+		if entry.IsDir() || a.visible(path.Join(name, entry.Name())) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, nil
+}
+
+// checkAllowed answers 404 and reports false when WORDS_RAIN_ALLOWED_WORDBOOKS
+// hides the named wordbook, so that it cannot be written either.
+func (s *server) checkAllowed(w http.ResponseWriter, name string) bool {
+	if a, ok := s.wordbooks.(allowedFS); ok && !a.allowed[name] {
+		writeJSONError(w, http.StatusNotFound, "wordbook not found")
+		return false
+	}
+	return true
+}
+
+// stdinWordbook names the in-memory wordbook read by --stdin.
+const stdinWordbook = "stdin"
+
+// readStdinWordbook reads all of f into an in-memory file system holding the
+// single wordbook stdinWordbook. f must not be a terminal, which would
+// block startup waiting for input.
+func readStdinWordbook(f *os.File) (fs.FS, error) {
+	if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return nil, errors.New("stdin is a terminal; pipe a word list in")
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return memFS{name: stdinWordbook + ".txt", data: data, modTime: time.Now()}, nil
+}
+
+// memFS is a read-only file system holding a single file, name, in its
+// root directory.
+type memFS struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (m memFS) Open(name string) (fs.File, error) {
+	switch name {
+	case ".":
+		return &memDir{fsys: m}, nil
+	case m.name:
+		return &memFile{Reader: bytes.NewReader(m.data), info: m.fileInfo()}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return []fs.DirEntry{fs.FileInfoToDirEntry(m.fileInfo())}, nil
+}
+
+func (m memFS) fileInfo() memFileInfo {
+	return memFileInfo{name: m.name, size: int64(len(m.data)), mode: 0o444, modTime: m.modTime}
+}
+
+// memFile is an open file of a memFS.
+type memFile struct {
+	*bytes.Reader
+	info memFileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is the open root directory of a memFS.
+type memDir struct {
+	fsys memFS
+	read bool
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) {
+	return memFileInfo{name: ".", mode: fs.ModeDir | 0o555, modTime: d.fsys.modTime}, nil
+}
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+
+func (d *memDir) Close() error { return nil }
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.read {
+		if n > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	return d.fsys.ReadDir(".")
+}
+
+// memFileInfo describes a file or directory of a memFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
+
+// stringsFlag is a flag that may be repeated, each value also split on
+// commas.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// shadowedWordbook is a wordbook hidden by one of the same name in an
+// earlier wordbooks directory.
+type shadowedWordbook struct {
+	Name string
+	Dir  string
+	By   string
+}
+
+// shadowedWordbooks lists the wordbooks in dirs that collide with a
+// wordbook in an earlier directory. Unreadable directories are skipped.
+func shadowedWordbooks(dirs []string) []shadowedWordbook {
+	var shadowed []shadowedWordbook
+	owner := make(map[string]string)
+	for _, dir := range dirs {
+		books, err := listWordbooks(os.DirFS(dir))
+		if err != nil {
+			continue
+		}
+		for _, name := range books {
+			if first, ok := owner[name]; ok {
+				shadowed = append(shadowed, shadowedWordbook{Name: name, Dir: dir, By: first})
+				continue
+			}
+			owner[name] = dir
+		}
+	}
+	return shadowed
+}
+
+func ensureDirExists(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	query := normalizeWord(r.URL.Query().Get("q"))
+	if query == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing query")
+		return
+	}
+	prefix := false
+	if v := r.URL.Query().Get("prefix"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid prefix")
+			return
+		}
+		prefix = b
+	}
+
+	books, err := listWordbooks(s.wordbooks)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+		return
+	}
+
+	matches := make([]string, 0)
+	for _, name := range books {
+		words, err := s.getWords(name)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+			return
+		}
+		if slices.ContainsFunc(words, func(word string) bool {
+			if prefix {
+				return strings.HasPrefix(word, query)
+			}
+			return word == query
+		}) {
+			matches = append(matches, name)
+		}
+	}
+
+	writeJSON(w, searchResponse{Query: query, Wordbooks: matches})
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	books, err := listWordbooks(s.wordbooks)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+		return
+	}
+	var latest time.Time
+	for _, name := range books {
+		info, err := fs.Stat(s.wordbooks, s.wordbookFile(name))
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+			return
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	key := fmt.Sprintf("%d/%d", len(books), latest.UnixNano())
+	if stats, ok := s.stats.get(key); ok {
+		writeJSON(w, stats)
+		return
+	}
+
+	stats := statsResponse{Wordbooks: len(books)}
+	seen := make(map[string]bool)
+	total := 0
+	for _, name := range books {
+		words, err := s.getWords(name)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+			return
+		}
+		total += len(words)
+		for _, word := range words {
+			if seen[word] {
+				continue
+			}
+			seen[word] = true
+			if stats.LongestWord == "" || longerWord(word, stats.LongestWord) {
+				stats.LongestWord = word
+			}
+			if stats.ShortestWord == "" || shorterWord(word, stats.ShortestWord) {
+				stats.ShortestWord = word
+			}
+		}
+	}
+	stats.UniqueWords = len(seen)
+	if len(books) > 0 {
+		stats.AverageWords = float64(total) / float64(len(books))
+	}
+
+	s.stats.set(key, stats)
+	writeJSON(w, stats)
+}
+
+// longerWord reports whether a has more runes than b, breaking ties
+// alphabetically so results are stable.
+func longerWord(a, b string) bool {
+	na, nb := utf8.RuneCountInString(a), utf8.RuneCountInString(b)
+	if na != nb {
+		return na > nb
+	}
+	return a < b
+}
+
+// shorterWord reports whether a has fewer runes than b, breaking ties
+// alphabetically so results are stable.
+func shorterWord(a, b string) bool {
+	na, nb := utf8.RuneCountInString(a), utf8.RuneCountInString(b)
+	if na != nb {
+		return na < nb
+	}
+	return a < b
+}
+
+// requestAccent returns the accent query parameter, or the saved accent when
+// it is absent, without persisting anything. It answers 400 and returns false
+// when the parameter is outside the allowed list; the saved accent is passed
+// through as it is, so that a broken config does not break word serving.
+func (s *server) requestAccent(w http.ResponseWriter, r *http.Request) (string, bool) {
+	accent := strings.TrimSpace(r.URL.Query().Get("accent"))
+	if accent == "" {
+		cfg, err := s.loadSettings()
+		if err == nil {
+			accent = strings.TrimSpace(cfg.Accent)
+		}
+		if accent == "" {
+			accent = "en-US"
+		}
+		return accent, true
+	}
+	cfg, err := s.loadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return "", false
+	}
+	accent, err = canonicalAccent(accent)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid accent: "+err.Error())
+		return "", false
+	}
+	if !slices.Contains(allowedAccents(cfg), accent) {
+		writeJSONError(w, http.StatusBadRequest, "invalid accent")
+		return "", false
+	}
+	return accent, true
+}
+
+// ttsTimeout bounds how long a single TTS command may run.
+const ttsTimeout = 10 * time.Second
+
+func (s *server) handleTTS(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	word := normalizeWord(r.URL.Query().Get("word"))
+	if word == "" || strings.HasPrefix(word, "-") {
+		writeJSONError(w, http.StatusBadRequest, "invalid word")
+		return
+	}
+	accent, ok := s.requestAccent(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ttsTimeout)
+	defer cancel()
+	audio, err := ttsCommand(ctx, s.ttsCommand, word, accent).Output()
+	if err != nil {
+		log.Printf("[%s] tts command failed: %v", requestID(r.Context()), err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to synthesize speech")
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Write(audio)
+}
+
+// ttsCommand builds the TTS command for word and accent, substituting the
+// {word} and {accent} placeholders in args. The word is appended when args
+// has no {word} placeholder. No shell is involved.
+func ttsCommand(ctx context.Context, args []string, word, accent string) *exec.Cmd {
+	expanded := make([]string, 0, len(args)+1)
+	hasWord := false
+	for _, arg := range args {
+		if strings.Contains(arg, "{word}") {
+			hasWord = true
+		}
+		arg = strings.ReplaceAll(arg, "{word}", word)
+		arg = strings.ReplaceAll(arg, "{accent}", accent)
+		expanded = append(expanded, arg)
+	}
+	if !hasWord {
+		expanded = append(expanded, word)
+	}
+	return exec.CommandContext(ctx, expanded[0], expanded[1:]...)
+}
+
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	// The stream outlives --write-timeout, so lift the deadline.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: {}\n\n", event)
+			flusher.Flush()
+		}
+	}
+}
+
+// warmup reads every wordbook into the cache so that first requests do not
+// wait on the disk.
+func (s *server) warmup() {
+	start := time.Now()
+	books, err := listWordbooks(s.wordbooks)
+	if err != nil {
+		log.Printf("warmup failed: %v", err)
+		return
+	}
+	for _, name := range books {
+		if _, err := s.getWords(name); err != nil {
+			log.Printf("warmup: failed to read %s: %v", name, err)
+		}
+	}
+	log.Printf("warmed up %d wordbooks in %s", len(books), time.Since(start).Round(time.Millisecond))
+}
+
+// checkWritable answers 403 and returns false when the wordbooks cannot be
+// changed.
+func (s *server) checkWritable(w http.ResponseWriter) bool {
+	if s.readOnly {
+		writeJSONError(w, http.StatusForbidden, "wordbooks are read-only")
+		return false
+	}
+	return true
+}
+
+// checkWritableWordbook answers 403 and returns false when the named
+// wordbook cannot be changed, either because no wordbook can or because it
+// is the in-memory wordbook read by --stdin.
+func (s *server) checkWritableWordbook(w http.ResponseWriter, name string) bool {
+	if !s.checkWritable(w) {
+		return false
+	}
+	if s.stdin && name == stdinWordbook {
+		writeJSONError(w, http.StatusForbidden, "wordbook stdin is read-only")
+		return false
+	}
+	return true
+}
+
+// checkUncompressed answers 409 and returns false when the named wordbook is
+// stored gzip-compressed, which is read-only.
+func (s *server) checkUncompressed(w http.ResponseWriter, name string) bool {
+	if isGzipFile(s.wordbookFile(name)) {
+		writeJSONError(w, http.StatusConflict, "compressed wordbooks are read-only")
+		return false
+	}
+	return true
+}
+
+// wordbooksChanged drops cached wordbook data and notifies event subscribers.
+func (s *server) wordbooksChanged() {
+	s.words.Range(func(key, _ any) bool {
+		s.words.Delete(key)
+		return true
+	})
+	s.events.publish("wordbooks-changed")
+}
+
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	if _, err := fs.ReadDir(s.wordbooks, "."); err != nil {
+		writeJSONStatus(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable"})
+		return
+	}
+
+	writeJSON(w, healthResponse{Status: "ok"})
+}
+
+func (s *server) handleWordbooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listWordbooksHandler(w, r)
+	case http.MethodPost:
+		s.createWordbook(w, r)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (s *server) listWordbooksHandler(w http.ResponseWriter, r *http.Request) {
+	books, err := listWordbooks(s.wordbooks)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+		return
+	}
+	switch r.URL.Query().Get("sort") {
+	case "", "name":
+	case "name-desc":
+		slices.Reverse(books)
+	case "natural":
+		sortWordbookNames(books, naturalLess)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "invalid sort")
+		return
+	}
+
+	etag, err := s.wordbooksETag(books)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	tags := r.URL.Query()["tag"]
+	names := make([]string, 0, len(books))
+	infos := make([]wordbookInfo, 0, len(books))
+	for _, name := range books {
+		cached, err := s.cachedWordbook(name)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+			return
+		}
+		meta, err := readMeta(s.wordbooks, s.metaFile(name))
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook metadata")
+			return
+		}
+		meta = mergeDirectives(meta, cached.directives)
+		if !hasTags(meta, tags) {
+			continue
+		}
+		names = append(names, name)
+		infos = append(infos, wordbookInfo{
+			Name:        name,
+			Count:       len(cached.words),
+			Title:       meta.Title,
+			Description: meta.Description,
+			Tags:        meta.Tags,
+			Directives:  cached.directives,
+		})
+	}
+
+	writeJSON(w, wordbookListResponse{Wordbooks: names, Books: infos})
+}
+
+// wordbooksETag derives an entity tag from the wordbook names and their
+// modification times, so it changes whenever a book is added, removed,
+// renamed or edited.
+func (s *server) wordbooksETag(books []string) (string, error) {
+	h := sha256.New()
+	for _, name := range books {
+		info, err := fs.Stat(s.wordbooks, s.wordbookFile(name))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d", name, info.ModTime().UnixNano())
+		if info, err := fs.Stat(s.wordbooks, s.metaFile(name)); err == nil {
+			fmt.Fprintf(h, "\x00%d", info.ModTime().UnixNano())
+		}
+		h.Write([]byte{'\n'})
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) createWordbook(w http.ResponseWriter, r *http.Request) {
+	if !s.checkWritable(w) {
+		return
+	}
+	var req wordbookCreateRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	name, ok := cleanWordbookName(req.Name)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid wordbook name")
+		return
+	}
+	if !s.checkAllowed(w, name) || !s.checkReservedName(w, name) {
+		return
+	}
+
+	if !s.checkWords(w, req.Words, 1) {
+		return
+	}
+
+	words := normalizeWords(req.Words)
+	if err := createWordbookFile(s.wordbookPath(name), words); err != nil {
+		if os.IsExist(err) {
+			writeJSONError(w, http.StatusConflict, "wordbook already exists")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to create wordbook")
+		return
+	}
+	s.wordbooksChanged()
+	s.recordHistory(r, name, len(words))
+
+	writeJSONStatus(w, http.StatusCreated, wordbookWordsResponse{Name: name, Words: words, Total: len(words)})
+}
+
+// checkWords validates raw words against the configured word pattern. If any
+// fail, it answers 422 listing each offending word with its line number,
+// counted from firstLine, and returns false.
+func (s *server) checkWords(w http.ResponseWriter, raw []string, firstLine int) bool {
+	cfg, err := s.loadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return false
+	}
+	pattern := defaultWordPattern
+	if cfg.WordPattern != "" {
+		pattern, err = regexp.Compile(cfg.WordPattern)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "invalid WORDS_RAIN_WORD_PATTERN")
+			return false
+		}
+	}
+
+	invalid := make([]invalidWord, 0)
+	for i, value := range raw {
+		word := normalizeWord(value)
+		if word == "" || pattern.MatchString(word) {
+			continue
+		}
+		invalid = append(invalid, invalidWord{Line: firstLine + i, Word: value})
+	}
+	if len(invalid) == 0 {
+		return true
+	}
+	writeJSONStatus(w, http.StatusUnprocessableEntity, invalidWordsResponse{
+		Error:   "words do not match the allowed pattern",
+		Pattern: pattern.String(),
+		Invalid: invalid,
+	})
+	return false
+}
+
+// fetchTimeout bounds how long downloading a wordbook from a URL may take.
+const fetchTimeout = 30 * time.Second
+
+// errFetchAddressRefused is returned when a fetch would connect to an
+// address on the server's own host or network.
+var errFetchAddressRefused = errors.New("refusing to connect to a loopback, private or link-local address")
+
+// refuseInternalAddress is a net.Dialer Control func that refuses loopback,
+// private, link-local and unspecified addresses. It runs on every
+// connection, so it also covers redirects and names resolving to them.
+func refuseInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return errFetchAddressRefused
+	}
+	return nil
+}
+
+// newFetchClient returns the client used to download wordbooks. It ignores
+// proxy settings, as a proxy would connect on the server's behalf and bypass
+// the address check.
+func newFetchClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   fetchTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   refuseInternalAddress,
+	}).DialContext
+	return &http.Client{Timeout: fetchTimeout, Transport: transport}
+}
+
+// handleFetchWordbook creates a wordbook from a plain-text word list
+// downloaded over HTTP(S), parsed like a wordbook file. Downloads larger
+// than --import-max-bytes are refused, as are URLs on the server's own
+// host or network.
+func (s *server) handleFetchWordbook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if !s.checkWritable(w) {
+		return
+	}
+	var req wordbookFetchRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	name, ok := cleanWordbookName(req.Name)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid wordbook name")
+		return
+	}
+	if !s.checkAllowed(w, name) || !s.checkReservedName(w, name) {
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid url: expected http or https")
+		return
+	}
+	if _, err := fs.Stat(s.wordbooks, s.wordbookFile(name)); err == nil {
+		writeJSONError(w, http.StatusConflict, "wordbook already exists")
+		return
+	}
+
+	fetchReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid url")
+		return
+	}
+	client := s.fetchClient
+	if client == nil {
+		client = newFetchClient()
+	}
+	resp, err := client.Do(fetchReq)
+	if errors.Is(err, errFetchAddressRefused) {
+		writeJSONError(w, http.StatusForbidden, "url resolves to a loopback, private or link-local address")
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] failed to fetch %s: %v", requestID(r.Context()), u.Redacted(), err)
+		writeJSONError(w, http.StatusBadGateway, "failed to fetch url")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("fetching url returned %s", resp.Status))
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, s.importMaxBytes+1))
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, "failed to fetch url")
+		return
+	}
+	if int64(len(data)) > s.importMaxBytes {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("fetched file is larger than %d bytes", s.importMaxBytes))
+		return
+	}
+	if !utf8.Valid(data) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "fetched file is not UTF-8 text")
+		return
+	}
+
+	lines := splitWordbookLines(data)
+	for i, line := range lines {
+		lines[i] = wordField(line, s.fieldSep)
+	}
+	if !s.checkWords(w, lines, 1) {
+		return
+	}
+	words := normalizeWords(lines)
+	if len(words) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "fetched file has no words")
+		return
+	}
+	if err := createWordbookFile(s.wordbookPath(name), words); err != nil {
+		if os.IsExist(err) {
+			writeJSONError(w, http.StatusConflict, "wordbook already exists")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to create wordbook")
+		return
+	}
+	s.wordbooksChanged()
+	s.recordHistory(r, name, len(words))
+
+	writeJSONStatus(w, http.StatusCreated, wordbookWordsResponse{Name: name, Words: words, Total: len(words)})
+}
+
+// handleImportCSV creates a wordbook from one column of an uploaded CSV file.
+// The multipart form carries the file, the wordbook name, the zero-based
+// column index, and an optional header flag to skip the first row.
+func (s *server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if !s.checkWritable(w) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.importMaxBytes)
+	if err := r.ParseMultipartForm(s.importMaxBytes); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "import file too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "invalid multipart form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	name, ok := cleanWordbookName(r.FormValue("name"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid wordbook name")
+		return
+	}
+	if !s.checkAllowed(w, name) || !s.checkReservedName(w, name) {
+		return
+	}
+	column := 0
+	if v := r.FormValue("column"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid column")
+			return
+		}
+		column = n
+	}
+	header := false
+	if v := r.FormValue("header"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid header")
+			return
+		}
+		header = b
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "missing file")
+		return
+	}
+	defer file.Close()
+
+	values, err := readCSVColumn(file, column, header)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	firstLine := 1
+	if header {
+		firstLine = 2
+	}
+	if !s.checkWords(w, values, firstLine) {
+		return
+	}
+
+	words := normalizeWords(values)
+	if err := createWordbookFile(s.wordbookPath(name), words); err != nil {
+		if os.IsExist(err) {
+			writeJSONError(w, http.StatusConflict, "wordbook already exists")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to create wordbook")
+		return
+	}
+	s.wordbooksChanged()
+	s.recordHistory(r, name, len(words))
+
+	writeJSONStatus(w, http.StatusCreated, wordbookWordsResponse{Name: name, Words: words, Total: len(words)})
+}
+
+// readCSVColumn returns the values of the given zero-based column of a CSV
+// stream, optionally skipping a header row.
+func readCSVColumn(r io.Reader, column int, header bool) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	values := make([]string, 0)
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		if header && row == 1 {
+			continue
+		}
+		if column >= len(record) {
+			return nil, fmt.Errorf("row %d has no column %d", row, column)
+		}
+		values = append(values, record[column])
+	}
+	return values, nil
+}
+
+func (s *server) handleWordbook(w http.ResponseWriter, r *http.Request) {
+	// The trailing-slash form of the collection behaves like /api/wordbooks.
+	if r.URL.Path == "/api/wordbooks/" {
+		s.handleWordbooks(w, r)
+		return
+	}
+
+	name, action, ok := parseWordbookPath(r.URL.Path)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid wordbook name")
+		return
+	}
+	if !s.checkAllowed(w, name) {
+		return
+	}
+
+	switch action {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleWordbookWords(w, r, name)
+		case http.MethodPatch:
+			s.appendWordbook(w, r, name)
+		case http.MethodDelete:
+			s.deleteWordbook(w, r, name)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		}
+	case "rename":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		s.renameWordbook(w, r, name)
+	case "random":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleRandomWord(w, r, name)
+	case "export":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.exportWordbook(w, r, name)
+	case "full":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleWordbookEntries(w, r, name)
+	case "words":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleWordbookWords(w, r, name)
+		case http.MethodDelete:
+			s.removeWords(w, r, name)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case "lint":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleLint(w, r, name)
+	case "count":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleWordbookCount(w, r, name)
+	case "normalize":
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		s.normalizeWordbook(w, r, name)
+	case "complete":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleComplete(w, r, name)
+	case "contains":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleContains(w, r, name)
+	case "ranked":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		s.handleRankedWords(w, r, name)
+	case "meta":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleMeta(w, r, name)
+		case http.MethodPut:
+			s.handleMetaUpdate(w, r, name)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut)
+		}
+	case "progress":
+		switch r.Method {
+		case http.MethodGet:
+			s.handleProgress(w, r, name)
+		case http.MethodPut:
+			s.handleProgressUpdate(w, r, name)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut)
+		}
+	}
+}
+
+// wordbookActions are the sub-resources addressable as
+// /api/wordbooks/{name}/{action}.
+var wordbookActions = map[string]bool{
+	"rename":    true,
+	"random":    true,
+	"export":    true,
+	"progress":  true,
+	"full":      true,
+	"meta":      true,
+	"ranked":    true,
+	"contains":  true,
+	"words":     true,
+	"count":     true,
+	"normalize": true,
+	"complete":  true,
+	"lint":      true,
+}
+
+// wordbookRoutes are the fixed routes under /api/wordbooks/, which shadow
+// wordbooks of the same name.
+var wordbookRoutes = map[string]bool{
+	"import":    true,
+	"fetch":     true,
+	"merged":    true,
+	"conflicts": true,
+	"random":    true,
+}
+
+// checkReservedName reports false when name cannot be created. It answers
+// 400 when requests for name would be routed elsewhere, as with toefl/random,
+// which addresses the random action of toefl, or merged, and 409 for the
+// in-memory wordbook read by --stdin, which would hide a file of that name.
+func (s *server) checkReservedName(w http.ResponseWriter, name string) bool {
+	if wordbookActions[path.Base(name)] || wordbookRoutes[name] {
+		writeJSONError(w, http.StatusBadRequest, "reserved wordbook name")
+		return false
+	}
+	if s.stdin && name == stdinWordbook {
+		writeJSONError(w, http.StatusConflict, "wordbook already exists")
+		return false
+	}
+	return true
+}
+
+// parseWordbookPath splits a /api/wordbooks/ request path into the wordbook
+// name and an optional trailing action.
+func parseWordbookPath(urlPath string) (name, action string, ok bool) {
+	rest := strings.TrimPrefix(urlPath, "/api/wordbooks/")
+	if i := strings.LastIndex(rest, "/"); i >= 0 && wordbookActions[rest[i+1:]] {
+		rest, action = rest[:i], rest[i+1:]
+	}
+	name, err := url.PathUnescape(rest)
+	if err != nil {
+		return "", "", false
+	}
+	name, ok = cleanWordbookName(name)
+	return name, action, ok
+}
+
+func (s *server) handleWordbookWords(w http.ResponseWriter, r *http.Request, name string) {
+	lowercase := true
+	if v := r.URL.Query().Get("lowercase"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid lowercase")
+			return
+		}
+		lowercase = b
+	}
+
+	accent, ok := s.requestAccent(w, r)
+	if !ok {
+		return
+	}
+
+	file := s.wordbookFile(name)
+	info, err := fs.Stat(s.wordbooks, file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	if shuffle, _ := strconv.ParseBool(r.URL.Query().Get("shuffle")); shuffle && r.URL.Query().Get("seed") == "" {
+		// Every response is shuffled anew.
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+		if notModified(w, r, info.ModTime(), s.wordsETag(name, info, r.URL.RawQuery, accent)) {
+			return
+		}
+	}
+
+	var words []string
+	if lowercase {
+		// Clone the shared cached slice, which shuffling would reorder.
+		words, err = s.getWords(name)
+		words = slices.Clone(words)
+	} else {
+		words, err = readWordbookPreservingCase(s.wordbooks, file, s.fieldSep)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	words = wordsAfter(words, r.URL.Query().Get("after"))
+	dedupe, err := parseDedupe(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if dedupe {
+		words = dedupeWords(words)
+	}
+
+	if difficulty := r.URL.Query().Get("difficulty"); difficulty != "" {
+		if !slices.Contains(difficulties, difficulty) {
+			writeJSONError(w, http.StatusBadRequest, "invalid difficulty")
+			return
+		}
+		ranks, err := s.freqRanks(name)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to read frequency file")
+			return
+		}
+		words = filterWordsByDifficulty(words, ranks, difficulty)
+	}
+
+	words, err = filterWordsByLength(r.URL.Query(), words)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := shuffleWords(r.URL.Query(), words); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	total := len(words)
+	words, err = paginateWords(r.URL.Query(), words)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, wordbookWordsResponse{Name: name, Words: words, Total: total, Accent: accent})
+}
+
+// parseDedupe reads the optional dedupe query parameter, which drops
+// repeated words.
+func parseDedupe(q url.Values) (bool, error) {
+	v := q.Get("dedupe")
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid dedupe")
+	}
+	return b, nil
+}
+
+// handleWordbookCount reports how many words a wordbook has, as many as
+// GET /api/wordbooks/{name} would return with the same dedupe option.
+func (s *server) handleWordbookCount(w http.ResponseWriter, r *http.Request, name string) {
+	dedupe, err := parseDedupe(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cached, err := s.cachedWordbook(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	count := len(cached.words)
+	if dedupe {
+		count = len(cached.set)
+	}
+	writeJSON(w, wordbookCountResponse{Name: name, Count: count})
+}
+
+// handleSelectedWords serves the words of the wordbook selected in the
+// settings, taking the same query parameters as GET /api/wordbooks/{name}.
+func (s *server) handleSelectedWords(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	cfg, err := s.loadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	if strings.TrimSpace(cfg.Wordbook) == "" {
+		writeJSONError(w, http.StatusNotFound, "no wordbook selected")
+		return
+	}
+	name, ok := cleanWordbookName(cfg.Wordbook)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "wordbook not found")
+		return
+	}
+	s.handleWordbookWords(w, r, name)
+}
+
+// wordsAfter returns the words following marker in file order, or all words
+// when marker is empty or not among them.
+func wordsAfter(words []string, marker string) []string {
+	marker = normalizeWord(marker)
+	if marker == "" {
+		return words
+	}
+	i := slices.IndexFunc(words, func(word string) bool { return normalizeWord(word) == marker })
+	if i < 0 {
+		return words
+	}
+	return words[i+1:]
+}
+
+// handleExportAll streams a zip archive of every .txt file among the
+// wordbooks, keeping their relative paths.
+func (s *server) handleExportAll(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "wordbooks.zip"}))
+	zw := zip.NewWriter(w)
+	err := fs.WalkDir(s.wordbooks, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if p != "." && strings.HasPrefix(entry.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !isWordbookFile(entry.Name()) {
+			return nil
+		}
+		return addToZip(zw, s.wordbooks, p)
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// The archive is already partly sent, so the client sees a
+		// truncated download rather than an error status.
+		log.Printf("[%s] failed to export wordbooks: %v", requestID(r.Context()), err)
+	}
+}
+
+// addToZip copies the file at p in fsys into zw under the same name.
+func addToZip(zw *zip.Writer, fsys fs.FS, p string) error {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = p
+	header.Method = zip.Deflate
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// handleConflicts lists the wordbooks in different directories that share a
+// base name, such as a/animals and b/animals.
+func (s *server) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	books, err := listWordbooks(s.wordbooks)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+		return
+	}
+	writeJSON(w, conflictsResponse{Conflicts: wordbookConflicts(books)})
+}
+
+// wordbookConflicts groups the books whose base names collide. Books keep
+// their full relative paths as canonical names; the report only helps in
+// renaming them apart.
+func wordbookConflicts(books []string) []wordbookConflict {
+	byBase := make(map[string][]string)
+	var bases []string
+	for _, name := range books {
+		base := path.Base(name)
+		if _, ok := byBase[base]; !ok {
+			bases = append(bases, base)
+		}
+		byBase[base] = append(byBase[base], name)
+	}
+	sort.Strings(bases)
+
+	conflicts := make([]wordbookConflict, 0)
+	for _, base := range bases {
+		if len(byBase[base]) > 1 {
+			conflicts = append(conflicts, wordbookConflict{Name: base, Wordbooks: byBase[base]})
+		}
+	}
+	return conflicts
+}
+
+// handleMergedWordbooks serves the de-duplicated union of the wordbooks
+// listed in the comma-separated names query parameter.
+func (s *server) handleMergedWordbooks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var names []string
+	for _, raw := range strings.Split(r.URL.Query().Get("names"), ",") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		name, ok := cleanWordbookName(raw)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "invalid wordbook name")
+			return
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "missing names")
+		return
+	}
+	accent, ok := s.requestAccent(w, r)
+	if !ok {
+		return
+	}
+
+	var words []string
+	for _, name := range names {
+		bookWords, err := s.getWords(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				writeJSONError(w, http.StatusNotFound, fmt.Sprintf("wordbook %q not found", name))
+				return
+			}
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+			return
+		}
+		words = append(words, bookWords...)
+	}
+	words = dedupeWords(words)
+
+	words, err := filterWordsByLength(r.URL.Query(), words)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := shuffleWords(r.URL.Query(), words); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, wordbookWordsResponse{Name: strings.Join(names, ","), Words: words, Total: len(words), Accent: accent})
+}
+
+// notModified sets Last-Modified from modTime and ETag to etag, and answers
+// 304 and returns true when the request's If-None-Match matches etag or,
+// without If-None-Match, its If-Modified-Since is not older than modTime.
+func notModified(w http.ResponseWriter, r *http.Request, modTime time.Time, etag string) bool {
+	modTime = modTime.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+	w.Header().Set("ETag", etag)
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modTime.After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// wordsETag derives an entity tag for the words of the named wordbook, whose
+// file has info, as served for query and accent. It covers everything the
+// response depends on: the wordbook and frequency files, the query and the
+// accent, which may come from the settings.
+func (s *server) wordsETag(name string, info fs.FileInfo, query, accent string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%s", name, info.ModTime().UnixNano(), info.Size(), query, accent)
+	file := s.freqFile(name)
+	if freq, err := fs.Stat(s.wordbooks, file); err == nil {
+		fmt.Fprintf(h, "\x00%s\x00%d\x00%d", file, freq.ModTime().UnixNano(), freq.Size())
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// difficulties are the buckets of the difficulty query parameter, from the
+// most to the least frequent words.
+var difficulties = []string{"easy", "medium", "hard"}
+
+// filterWordsByDifficulty keeps the words in the given difficulty bucket.
+// The words with a frequency rank are split into thirds by rank; words
+// without one are hard.
+func filterWordsByDifficulty(words []string, ranks map[string]int, difficulty string) []string {
+	ranked := make([]string, 0, len(words))
+	for _, word := range words {
+		if _, ok := ranks[normalizeWord(word)]; ok {
+			ranked = append(ranked, word)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranks[normalizeWord(ranked[i])] < ranks[normalizeWord(ranked[j])]
+	})
+	bucket := make(map[string]string, len(ranked))
+	for i, word := range ranked {
+		bucket[word] = difficulties[i*len(difficulties)/len(ranked)]
+	}
+
+	filtered := make([]string, 0, len(words))
+	for _, word := range words {
+		b, ok := bucket[word]
+		if !ok {
+			b = "hard"
+		}
+		if b == difficulty {
+			filtered = append(filtered, word)
+		}
+	}
+	return filtered
+}
+
+// filterWordsByLength keeps only the words whose rune count lies within the
+// optional minLen and maxLen query parameters.
+func filterWordsByLength(q url.Values, words []string) ([]string, error) {
+	if !q.Has("minLen") && !q.Has("maxLen") {
+		return words, nil
+	}
+
+	minLen := 0
+	if v := q.Get("minLen"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid minLen")
+		}
+		minLen = n
+	}
+	maxLen := -1
+	if v := q.Get("maxLen"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid maxLen")
+		}
+		maxLen = n
+	}
+
+	filtered := make([]string, 0, len(words))
+	for _, word := range words {
+		n := utf8.RuneCountInString(word)
+		if n < minLen || (maxLen >= 0 && n > maxLen) {
+			continue
+		}
+		filtered = append(filtered, word)
+	}
+	return filtered, nil
+}
+
+// shuffleWords shuffles words in place when the shuffle query parameter is
+// true. An optional seed makes the order reproducible.
+func shuffleWords(q url.Values, words []string) error {
+	if !q.Has("shuffle") {
+		return nil
+	}
+	shuffle, err := strconv.ParseBool(q.Get("shuffle"))
+	if err != nil {
+		return fmt.Errorf("invalid shuffle")
+	}
+	if !shuffle {
+		return nil
+	}
+
+	swap := func(i, j int) { words[i], words[j] = words[j], words[i] }
+	if v := q.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid seed")
+		}
+		rand.New(rand.NewSource(seed)).Shuffle(len(words), swap)
+		return nil
+	}
+	rand.Shuffle(len(words), swap)
+	return nil
+}
+
+// paginateWords applies the optional offset and limit query parameters. The
+// page size defaults to defaultWordsPageLimit, so that large wordbooks are
+// never sent whole.
+func paginateWords(q url.Values, words []string) ([]string, error) {
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid offset")
+		}
+		offset = n
+	}
+	limit := defaultWordsPageLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid limit")
+		}
+		limit = n
+	}
+
+	if offset >= len(words) {
+		return []string{}, nil
+	}
+	end := len(words)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	return words[offset:end], nil
+}
+
+func (s *server) appendWordbook(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkWritableWordbook(w, name) || !s.checkUncompressed(w, name) {
+		return
+	}
+	var req wordbookAppendRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	if !s.checkWords(w, req.Words, 1) {
+		return
+	}
+
+	s.wordbooksMu.Lock()
+	defer s.wordbooksMu.Unlock()
+	path := s.wordbookPath(name)
+	words, err := readWordbook(s.wordbooks, s.wordbookFile(name), s.fieldSep)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	seen := make(map[string]bool, len(words))
+	for _, word := range words {
+		seen[word] = true
+	}
+	resp := wordbookAppendResponse{Name: name}
+	added := make([]string, 0, len(req.Words))
+	for _, word := range normalizeWords(req.Words) {
+		if seen[word] {
+			resp.Skipped++
+			continue
+		}
+		seen[word] = true
+		added = append(added, word)
+		resp.Added++
+	}
+
+	if resp.Added > 0 {
+		// Append to the original bytes so comments and definitions survive.
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		data = append(data, formatWordbook(added)...)
+		if err := writeFileAtomic(path, data, 0o644); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to write wordbook")
+			return
+		}
+		s.wordbooksChanged()
+		s.recordHistory(r, name, resp.Added)
+	}
+
+	writeJSON(w, resp)
+}
+
+// normalizeWordbook rewrites a wordbook file with its words normalized,
+// deduplicated and sorted, reporting the word counts before and after.
+// Definitions and "#!" directives are kept; other comments are dropped.
+func (s *server) normalizeWordbook(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkWritableWordbook(w, name) || !s.checkUncompressed(w, name) {
+		return
+	}
+
+	s.wordbooksMu.Lock()
+	defer s.wordbooksMu.Unlock()
+	path := s.wordbookPath(name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	var directives []string
+	for _, line := range strings.Split(strings.TrimPrefix(string(data), "\ufeff"), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "#!") {
+			directives = append(directives, line)
+		}
+	}
+	resp := wordbookNormalizeResponse{Name: name}
+	seen := make(map[string]bool)
+	entries := make([]wordEntry, 0)
+	for _, line := range splitWordbookLines(data) {
+		word, definition, _ := strings.Cut(line, s.fieldSep)
+		word = normalizeWord(word)
+		if word == "" {
+			continue
+		}
+		resp.Before++
+		if seen[word] {
+			continue
+		}
+		seen[word] = true
+		entries = append(entries, wordEntry{Word: word, Definition: strings.TrimSpace(definition)})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Word < entries[j].Word })
+	resp.After = len(entries)
+
+	var b strings.Builder
+	for _, line := range directives {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	for _, entry := range entries {
+		b.WriteString(strings.ReplaceAll(entry.Word, "#", "\\#"))
+		if entry.Definition != "" {
+			b.WriteString(s.fieldSep)
+			b.WriteString(strings.ReplaceAll(entry.Definition, "#", "\\#"))
+		}
+		b.WriteByte('\n')
+	}
+	if err := writeFileAtomic(path, []byte(b.String()), 0o644); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to write wordbook")
+		return
+	}
+	s.wordbooksChanged()
+
+	writeJSON(w, resp)
+}
+
+// removeWords deletes the lines of the requested words from a wordbook,
+// keeping every other line, comments included, as it was.
+func (s *server) removeWords(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkWritableWordbook(w, name) || !s.checkUncompressed(w, name) {
+		return
+	}
+	var req wordbookRemoveRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+
+	s.wordbooksMu.Lock()
+	defer s.wordbooksMu.Unlock()
+	path := s.wordbookPath(name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	remove := make(map[string]bool)
+	for _, word := range normalizeWords(req.Words) {
+		remove[word] = true
+	}
+	found := make(map[string]bool)
+	lines := strings.SplitAfter(string(data), "\n")
+	kept := lines[:0]
+	for i, line := range lines {
+		text := strings.TrimRight(line, "\r\n")
+		if i == 0 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		word := normalizeWord(wordField(stripComment(text), s.fieldSep))
+		if remove[word] {
+			found[word] = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+
+	if len(found) > 0 {
+		if err := writeFileAtomic(path, []byte(strings.Join(kept, "")), 0o644); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to write wordbook")
+			return
+		}
+		s.wordbooksChanged()
+	}
+
+	writeJSON(w, wordbookRemoveResponse{Name: name, Removed: len(found), NotFound: len(remove) - len(found)})
+}
+
+func (s *server) handleWordbookEntries(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := readWordbookEntries(s.wordbooks, s.wordbookFile(name), s.fieldSep)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	writeJSON(w, wordbookEntriesResponse{Name: name, Words: entries})
+}
+
+// handleLint reports source-level problems of a wordbook file: duplicate
+// words, trailing whitespace, non-ASCII words and empty lines. Line numbers
+// are one-based.
+func (s *server) handleLint(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := readWordbookFile(s.wordbooks, s.wordbookFile(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	resp := lintResponse{
+		Name:               name,
+		Duplicates:         make([]lintDuplicate, 0),
+		TrailingWhitespace: make([]int, 0),
+		NonASCII:           make([]lintWord, 0),
+		EmptyLines:         make([]int, 0),
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	firstLine := make(map[string]int)
+	duplicate := make(map[string]int)
+	for i, line := range lines {
+		lineNo := i + 1
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			resp.EmptyLines = append(resp.EmptyLines, lineNo)
+			continue
+		}
+		if strings.TrimRight(line, " \t") != line {
+			resp.TrailingWhitespace = append(resp.TrailingWhitespace, lineNo)
+		}
+		word := normalizeWord(wordField(stripComment(line), s.fieldSep))
+		if word == "" {
+			continue
+		}
+		if !isASCII(word) {
+			resp.NonASCII = append(resp.NonASCII, lintWord{Word: word, Line: lineNo})
+		}
+		if first, ok := firstLine[word]; ok {
+			i, ok := duplicate[word]
+			if !ok {
+				i = len(resp.Duplicates)
+				duplicate[word] = i
+				resp.Duplicates = append(resp.Duplicates, lintDuplicate{Word: word, Lines: []int{first}})
+			}
+			resp.Duplicates[i].Lines = append(resp.Duplicates[i].Lines, lineNo)
+			continue
+		}
+		firstLine[word] = lineNo
+	}
+
+	writeJSON(w, resp)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// handleComplete returns up to limit words of a wordbook that start with the
+// normalized prefix query parameter, in alphabetical order.
+func (s *server) handleComplete(w http.ResponseWriter, r *http.Request, name string) {
+	limit := defaultCompleteLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	prefix := normalizeWord(r.URL.Query().Get("prefix"))
+
+	words, err := s.getWords(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	matches := make([]string, 0)
+	for _, word := range words {
+		if strings.HasPrefix(word, prefix) {
+			matches = append(matches, word)
+		}
+	}
+	matches = dedupeWords(matches)
+	sort.Strings(matches)
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	writeJSON(w, completeResponse{Words: matches})
+}
+
+// handleContains reports whether a wordbook contains the normalized word
+// query parameter.
+func (s *server) handleContains(w http.ResponseWriter, r *http.Request, name string) {
+	word := normalizeWord(r.URL.Query().Get("word"))
+	if word == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing word")
+		return
+	}
+
+	cached, err := s.cachedWordbook(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	writeJSON(w, containsResponse{Contains: cached.set[word]})
+}
+
+// handleRankedWords lists a wordbook's words with their rank in the
+// companion name.freq.txt or name.freq.txt.gz, most frequent first. Words missing from the
+// frequency file have a null rank and keep their file order at the end.
+func (s *server) handleRankedWords(w http.ResponseWriter, r *http.Request, name string) {
+	words, err := s.getWords(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	ranks, err := s.freqRanks(name)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read frequency file")
+		return
+	}
+
+	ranked := make([]rankedWord, len(words))
+	for i, word := range words {
+		ranked[i].Word = word
+		if rank, ok := ranks[word]; ok {
+			ranked[i].Rank = &rank
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i].Rank, ranked[j].Rank
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return *a < *b
+	})
+
+	writeJSON(w, wordbookRankedResponse{Name: name, Words: ranked})
+}
+
+// freqRanks maps each word of the named wordbook's frequency file to its
+// one-based line rank. A missing frequency file yields an empty map.
+func (s *server) freqRanks(name string) (map[string]int, error) {
+	words, err := readWordbook(s.wordbooks, s.freqFile(name), s.fieldSep)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]int{}, nil
+		}
+		return nil, err
+	}
+	ranks := make(map[string]int, len(words))
+	for i, word := range words {
+		ranks[word] = i + 1
+	}
+	return ranks, nil
+}
+
+func (s *server) handleRandomWord(w http.ResponseWriter, r *http.Request, name string) {
+	count := 0
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "invalid count")
+			return
+		}
+		count = n
+	}
+	accent, ok := s.requestAccent(w, r)
+	if !ok {
+		return
+	}
+
+	words, err := s.getWords(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	words = dedupeWords(words)
+	if len(words) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "wordbook is empty")
+		return
+	}
+
+	if count == 0 {
+		writeJSON(w, randomWordResponse{Word: words[rand.Intn(len(words))], Accent: accent})
+		return
+	}
+	picked := make([]string, 0, min(count, len(words)))
+	for _, i := range rand.Perm(len(words))[:cap(picked)] {
+		picked = append(picked, words[i])
+	}
+	writeJSON(w, randomWordsResponse{Words: picked, Accent: accent})
+}
+
+// handleRandomWordbook picks a wordbook at random, answering with its name
+// or, when withWords is true, with its words as GET /api/wordbooks/{name}
+// would. An optional seed makes the choice reproducible.
+func (s *server) handleRandomWordbook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	q := r.URL.Query()
+	withWords := false
+	if v := q.Get("withWords"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid withWords")
+			return
+		}
+		withWords = b
+	}
+	pick := rand.Intn
+	if v := q.Get("seed"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid seed")
+			return
+		}
+		pick = rand.New(rand.NewSource(seed)).Intn
+	}
+
+	books, err := listWordbooks(s.wordbooks)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+		return
+	}
+	if len(books) == 0 {
+		writeJSONError(w, http.StatusNotFound, "no wordbooks")
+		return
+	}
+
+	name := books[pick(len(books))]
+	if withWords {
+		s.handleWordbookWords(w, r, name)
+		return
+	}
+	writeJSON(w, randomWordbookResponse{Name: name})
+}
+
+// exportWordbook sends the words of a wordbook as a file download, either as
+// JSON or as the normalized text lines.
+func (s *server) exportWordbook(w http.ResponseWriter, r *http.Request, name string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "txt" {
+		writeJSONError(w, http.StatusBadRequest, "invalid format")
+		return
+	}
+
+	words, err := s.getWords(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	filename := path.Base(name) + "." + format
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	if format == "txt" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, formatWordbook(words))
+		return
+	}
+	writeJSON(w, wordbookWordsResponse{Name: name, Words: words, Total: len(words)})
+}
+
+func (s *server) handleProgress(w http.ResponseWriter, r *http.Request, name string) {
+	if _, err := fs.Stat(s.wordbooks, s.wordbookFile(name)); err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	progress, err := readProgress(s.progressPath(name))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read progress")
+		return
+	}
+	writeJSON(w, progress)
+}
+
+func (s *server) handleProgressUpdate(w http.ResponseWriter, r *http.Request, name string) {
+	var progress wordbookProgress
+	if !decodeJSONBody(w, r, &progress) {
+		return
+	}
+	if progress.Index < 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid index")
+		return
+	}
+	if _, err := fs.Stat(s.wordbooks, s.wordbookFile(name)); err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	if err := writeProgress(s.progressPath(name), progress); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to write progress")
+		return
+	}
+	writeJSON(w, progress)
+}
+
+func (s *server) handleMeta(w http.ResponseWriter, r *http.Request, name string) {
+	cached, err := s.cachedWordbook(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	meta, err := readMeta(s.wordbooks, s.metaFile(name))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook metadata")
+		return
+	}
+	writeJSON(w, wordbookMetaResponse{
+		wordbookMeta: mergeDirectives(meta, cached.directives),
+		Directives:   cached.directives,
+	})
+}
+
+func (s *server) handleMetaUpdate(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkWritableWordbook(w, name) {
+		return
+	}
+	var meta wordbookMeta
+	if !decodeJSONBody(w, r, &meta) {
+		return
+	}
+	meta.Title = strings.TrimSpace(meta.Title)
+	meta.Description = strings.TrimSpace(meta.Description)
+	tags := make([]string, 0, len(meta.Tags))
+	for _, tag := range meta.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	meta.Tags = tags
+
+	if _, err := fs.Stat(s.wordbooks, s.wordbookFile(name)); err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to encode wordbook metadata")
+		return
+	}
+	if err := writeFileAtomic(s.metaPath(name), append(data, '\n'), 0o644); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to write wordbook metadata")
+		return
+	}
+	s.wordbooksChanged()
+	writeJSON(w, meta)
+}
+
+// metaPath returns the path of the metadata file of the named wordbook,
+// next to the wordbook file.
+func (s *server) metaPath(name string) string {
+	return filepath.Join(s.wordbookDir(name), filepath.FromSlash(name)+".meta.json")
+}
+
+// metaFile returns the name of the named wordbook's metadata file within
+// s.wordbooks.
+func (s *server) metaFile(name string) string {
+	return name + ".meta.json"
+}
+
+// progressPath returns where the progress of the named wordbook is stored,
+// under a progress directory next to the config file.
+func (s *server) progressPath(name string) string {
+	return filepath.Join(filepath.Dir(s.configPath), "progress", filepath.FromSlash(name)+".json")
+}
+
+// historyPath returns the path of the history file, next to the config
+// file.
+func (s *server) historyPath() string {
+	return filepath.Join(filepath.Dir(s.configPath), "history.jsonl")
+}
+
+// recordHistory appends an entry for count words added to the named
+// wordbook. Failures are only logged, since the words are already saved.
+func (s *server) recordHistory(r *http.Request, name string, count int) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	err := appendHistory(s.historyPath(), historyEntry{Time: time.Now().UTC(), Wordbook: name, Count: count})
+	if err != nil {
+		log.Printf("[%s] failed to record history: %v", requestID(r.Context()), err)
+	}
+}
+
+func appendHistory(path string, entry historyEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// handleHistory lists the recorded word additions, oldest first. The
+// optional since parameter, a date such as 2024-05-01 or an RFC 3339 time,
+// keeps only the entries from then on.
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			t, err = time.ParseInLocation(time.DateOnly, v, time.Local)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+		since = t
+	}
+
+	entries, err := readHistory(s.historyPath())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read history")
+		return
+	}
+	filtered := make([]historyEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Time.Before(since) {
+			filtered = append(filtered, entry)
+		}
+	}
+	writeJSON(w, historyResponse{Entries: filtered})
+}
+
+// readHistory returns the entries of the history file, which need not exist.
+// Lines that do not parse are skipped.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (s *server) renameWordbook(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkWritableWordbook(w, name) || !s.checkUncompressed(w, name) {
+		return
+	}
+	var req wordbookRenameRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	newName, ok := cleanWordbookName(req.NewName)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid new wordbook name")
+		return
+	}
+	if !s.checkAllowed(w, newName) || !s.checkReservedName(w, newName) {
+		return
+	}
+
+	s.wordbooksMu.Lock()
+	defer s.wordbooksMu.Unlock()
+	// The wordbook keeps to the directory it is in.
+	dir := s.wordbookDir(name)
+	oldPath := filepath.Join(dir, filepath.FromSlash(name)+".txt")
+	newPath := filepath.Join(dir, filepath.FromSlash(newName)+".txt")
+	if _, err := os.Stat(oldPath); err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+		return
+	}
+	if _, err := fs.Stat(s.wordbooks, s.wordbookFile(newName)); err == nil {
+		writeJSONError(w, http.StatusConflict, "wordbook already exists")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o755); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to rename wordbook")
+		return
+	}
+	// Unlike os.Rename, os.Link fails when newPath exists, so a wordbook
+	// that appeared since the check above is never overwritten.
+	if err := os.Link(oldPath, newPath); err != nil {
+		if os.IsExist(err) {
+			writeJSONError(w, http.StatusConflict, "wordbook already exists")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to rename wordbook")
+		return
+	}
+	if err := os.Remove(oldPath); err != nil {
+		os.Remove(newPath)
+		writeJSONError(w, http.StatusInternalServerError, "failed to rename wordbook")
+		return
+	}
+	oldMeta := filepath.Join(dir, filepath.FromSlash(name)+".meta.json")
+	newMeta := filepath.Join(dir, filepath.FromSlash(newName)+".meta.json")
+	if err := os.Rename(oldMeta, newMeta); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] failed to rename metadata of %s: %v", requestID(r.Context()), name, err)
+	}
+	// Progress is kept with the config, keyed by wordbook name.
+	newProgress := s.progressPath(newName)
+	if err := os.MkdirAll(filepath.Dir(newProgress), 0o755); err != nil {
+		log.Printf("[%s] failed to rename progress of %s: %v", requestID(r.Context()), name, err)
+	} else if err := os.Rename(s.progressPath(name), newProgress); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] failed to rename progress of %s: %v", requestID(r.Context()), name, err)
+	}
+	s.wordbooksChanged()
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	cfg, err := loadConfigOptional(s.configPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	if strings.TrimSpace(cfg.Wordbook) == name {
+		s.fillConfigDefaults(&cfg)
+		cfg.Wordbook = newName
+		if err := s.saveConfig(cfg); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to write settings")
+			return
+		}
+	}
+
+	writeJSON(w, wordbookRenameResponse{Name: newName, PreviousName: name})
+}
+
+func (s *server) deleteWordbook(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkWritableWordbook(w, name) || !s.checkUncompressed(w, name) {
+		return
+	}
+	s.wordbooksMu.Lock()
+	defer s.wordbooksMu.Unlock()
+	if err := os.Remove(s.wordbookPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			writeJSONError(w, http.StatusNotFound, "wordbook not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, "failed to delete wordbook")
+		return
+	}
+	if err := os.Remove(s.metaPath(name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] failed to delete metadata of %s: %v", requestID(r.Context()), name, err)
+	}
+	if err := os.Remove(s.progressPath(name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[%s] failed to delete progress of %s: %v", requestID(r.Context()), name, err)
+	}
+	s.wordbooksChanged()
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	cfg, err := loadConfigOptional(s.configPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	if strings.TrimSpace(cfg.Wordbook) == name {
+		s.fillConfigDefaults(&cfg)
+		cfg.Wordbook = ""
+		if err := s.saveConfig(cfg); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to write settings")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	cfg, err := s.loadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+
+	accent := strings.TrimSpace(cfg.Accent)
+	if accent == "" {
+		accent = "en-US"
+	}
+	cfg.Accent = accent
+	cfg.Wordbook = strings.TrimSpace(cfg.Wordbook)
+	writeJSON(w, newSettingsResponse(cfg))
+}
+
+// newSettingsResponse reports the user-facing settings of cfg.
+func newSettingsResponse(cfg appConfig) settingsResponse {
+	theme := cfg.Theme
+	if theme == "" {
+		theme = "system"
+	}
+	return settingsResponse{
+		Accent:      cfg.Accent,
+		Wordbook:    cfg.Wordbook,
+		Speed:       cfg.Speed,
+		SessionSize: cfg.SessionSize,
+		Theme:       theme,
+	}
+}
+
+func (s *server) handleAccents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	cfg, err := s.loadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+
+	accents := allowedAccents(cfg)
+	infos := make([]accentInfo, 0, len(accents))
+	for _, code := range accents {
+		label, ok := accentLabels[code]
+		if !ok {
+			label = code
+		}
+		infos = append(infos, accentInfo{Code: code, Label: label})
+	}
+	writeJSON(w, accentListResponse{Accents: infos})
+}
+
+func (s *server) handleSettingsAccent(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPut) {
+		return
+	}
+
+	var req settingsAccentRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	accent, err := canonicalAccent(strings.TrimSpace(req.Accent))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid accent: "+err.Error())
+		return
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	cfg, err := loadConfigOptional(s.configPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	// The environment may change the allowed accents, but only the file's
+	// own values are written back.
+	settings := cfg
+	if err := applyEnvOverrides(&settings); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	if !slices.Contains(allowedAccents(settings), accent) {
+		writeJSONError(w, http.StatusBadRequest, "invalid accent")
+		return
+	}
+	s.fillConfigDefaults(&cfg)
+	if cfg.Host == "127.0.0.1" && cfg.Port == 8080 && cfg.WordbooksDir == strings.Join(s.wordbooksDirs, ",") && cfg.Accent == "" && !cfg.OpenBrowser {
+		cfg.OpenBrowser = true
+	}
+	cfg.Accent = accent
+
+	if err := s.saveConfig(cfg); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to write settings")
+		return
+	}
+
+	writeJSON(w, newSettingsResponse(cfg))
+}
+
+func (s *server) handleSettingsWordbook(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPut) {
+		return
+	}
+
+	var req settingsWordbookRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	var wordbook string
+	if req.Index != nil {
+		if req.Wordbook != "" {
+			writeJSONError(w, http.StatusBadRequest, "give either wordbook or index")
+			return
+		}
+		books, err := listWordbooks(s.wordbooks)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+			return
+		}
+		if *req.Index < 0 || *req.Index >= len(books) {
+			writeJSONError(w, http.StatusBadRequest, "index out of range")
+			return
+		}
+		wordbook = books[*req.Index]
+	} else {
+		name, ok := cleanWordbookName(req.Wordbook)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "invalid wordbook")
+			return
+		}
+		if _, err := fs.Stat(s.wordbooks, s.wordbookFile(name)); err != nil {
+			if os.IsNotExist(err) {
+				writeJSONError(w, http.StatusNotFound, "wordbook not found")
+				return
+			}
+			writeJSONError(w, http.StatusInternalServerError, "failed to read wordbook")
+			return
+		}
+		wordbook = name
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	cfg, err := loadConfigOptional(s.configPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	s.fillConfigDefaults(&cfg)
+	if cfg.Host == "127.0.0.1" && cfg.Port == 8080 && cfg.WordbooksDir == strings.Join(s.wordbooksDirs, ",") && cfg.Accent == "" && cfg.Wordbook == "" && !cfg.OpenBrowser {
+		cfg.OpenBrowser = true
+	}
+	if cfg.Accent == "" {
+		cfg.Accent = "en-US"
+	}
+	cfg.Wordbook = wordbook
+
+	if err := s.saveConfig(cfg); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to write settings")
+		return
+	}
+
+	writeJSON(w, newSettingsResponse(cfg))
+}
+
+// stepWordbook returns a handler that selects the wordbook delta places from
+// the current one in the sorted listing, wrapping around at the ends. With
+// no wordbook selected, stepping forward selects the first and stepping back
+// the last.
+func (s *server) stepWordbook(delta int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+
+		books, err := listWordbooks(s.wordbooks)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to list wordbooks")
+			return
+		}
+		if len(books) == 0 {
+			writeJSONError(w, http.StatusNotFound, "no wordbooks")
+			return
+		}
+
+		s.updateSettings(w, func(cfg *appConfig) {
+			i := slices.Index(books, cfg.Wordbook)
+			if i < 0 && delta < 0 {
+				i = 0
+			}
+			i = ((i+delta)%len(books) + len(books)) % len(books)
+			cfg.Wordbook = books[i]
+		})
+	})
+}
+
+func (s *server) handleSettingsSpeed(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPut) {
+		return
+	}
+
+	var req settingsSpeedRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	if req.Speed <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid speed")
+		return
 	}
-	if cfg.WordbooksDir == "" {
-		cfg.WordbooksDir = s.wordbooksDir
+
+	s.updateSettings(w, func(cfg *appConfig) { cfg.Speed = req.Speed })
+}
+
+func (s *server) handleSettingsSessionSize(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPut) {
+		return
 	}
-	if cfg.Host == "127.0.0.1" && cfg.Port == 8080 && cfg.WordbooksDir == s.wordbooksDir && cfg.Accent == "" && !cfg.OpenBrowser {
-		cfg.OpenBrowser = true
+
+	var req settingsSessionSizeRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
 	}
-	cfg.Accent = accent
+	if req.SessionSize < 1 {
+		writeJSONError(w, http.StatusBadRequest, "invalid session size")
+		return
+	}
+
+	s.updateSettings(w, func(cfg *appConfig) { cfg.SessionSize = req.SessionSize })
+}
 
-	if err := writeConfig(s.configPath, cfg); err != nil {
-		http.Error(w, "failed to write settings", http.StatusInternalServerError)
+func (s *server) handleSettingsTheme(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPut) {
 		return
 	}
 
-	writeJSON(w, settingsResponse{
-		Accent:   cfg.Accent,
-		Wordbook: cfg.Wordbook,
-	})
+	var req settingsThemeRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	theme := strings.TrimSpace(req.Theme)
+	if !slices.Contains(themes, theme) {
+		writeJSONError(w, http.StatusBadRequest, "invalid theme")
+		return
+	}
+
+	s.updateSettings(w, func(cfg *appConfig) { cfg.Theme = theme })
 }
 
-func (s *server) handleSettingsWordbook(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+// updateSettings applies update to the saved config and responds with the
+// resulting settings.
+func (s *server) updateSettings(w http.ResponseWriter, update func(cfg *appConfig)) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	cfg, err := loadConfigOptional(s.configPath)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	s.fillConfigDefaults(&cfg)
+	if cfg.Accent == "" {
+		cfg.Accent = "en-US"
+	}
+	update(&cfg)
+
+	if err := s.saveConfig(cfg); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to write settings")
 		return
 	}
 
-	var req settingsWordbookRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	writeJSON(w, newSettingsResponse(cfg))
+}
+
+// handleConfig reports the config resolved at startup, keyed like the config
+// file, with the settings that are read on each request as they are now.
+// The auth password and the values of unrecognized keys, which may be
+// secrets of other tools, are redacted.
+func (s *server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	current, err := s.loadSettings()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to read settings")
+		return
+	}
+	cfg := s.effectiveConfig
+	cfg.Accent = current.Accent
+	cfg.Accents = current.Accents
+	cfg.Wordbook = current.Wordbook
+	cfg.WordPattern = current.WordPattern
+	cfg.Speed = current.Speed
+	cfg.SessionSize = current.SessionSize
+	cfg.Theme = current.Theme
+	cfg.Extra = current.Extra
+
+	values := make(map[string]any)
+	for _, v := range configValues(cfg) {
+		values[v.Key] = v.Value
+	}
+	if _, ok := values["WORDS_RAIN_AUTH_PASS"]; ok {
+		values["WORDS_RAIN_AUTH_PASS"] = "[redacted]"
+	}
+	for _, entry := range cfg.Extra {
+		values[entry.Key] = "[redacted]"
+	}
+	writeJSON(w, configResponse{Path: s.configPath, Config: values})
+}
+
+// saveConfig persists cfg to the config file unless running with --dry-run.
+func (s *server) saveConfig(cfg appConfig) error {
+	if s.dryRun {
+		log.Printf("dry run: not writing config %s", s.configPath)
+		return nil
+	}
+	return writeConfig(s.configPath, cfg)
+}
+
+// fillConfigDefaults populates the connection settings of cfg that are unset,
+// so that rewriting the config never produces an unusable file.
+func (s *server) fillConfigDefaults(cfg *appConfig) {
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 8080
+	}
+	if cfg.WordbooksDir == "" {
+		cfg.WordbooksDir = strings.Join(s.wordbooksDirs, ",")
+	}
+}
+
+// wordbookPath returns the file path of the named wordbook in the directory
+// that holds it, see wordbookDir. The name must already have been validated
+// with cleanWordbookName.
+func (s *server) wordbookPath(name string) string {
+	return filepath.Join(s.wordbookDir(name), filepath.FromSlash(name)+".txt")
+}
+
+// wordbookDir returns the first of the wordbooks directories containing the
+// named wordbook, which is the one served, or the first directory for a
+// wordbook that does not exist yet.
+func (s *server) wordbookDir(name string) string {
+	for _, dir := range s.wordbooksDirs {
+		base := filepath.Join(dir, filepath.FromSlash(name))
+		for _, ext := range []string{".txt", ".txt.gz"} {
+			if _, err := os.Stat(base + ext); err == nil {
+				return dir
+			}
+		}
+	}
+	return s.wordbooksDir
+}
+
+// wordbookFile returns the name of the named wordbook's file within
+// s.wordbooks: name.txt, or name.txt.gz when only the compressed file
+// exists.
+func (s *server) wordbookFile(name string) string {
+	return s.plainOrGzip(name + ".txt")
+}
+
+// freqFile returns the name of the named wordbook's frequency file within
+// s.wordbooks: name.freq.txt, or name.freq.txt.gz when only the compressed
+// file exists.
+func (s *server) freqFile(name string) string {
+	return s.plainOrGzip(name + ".freq.txt")
+}
+
+// plainOrGzip returns file, or file.gz when only the compressed file exists.
+func (s *server) plainOrGzip(file string) string {
+	if _, err := fs.Stat(s.wordbooks, file); errors.Is(err, fs.ErrNotExist) {
+		if _, err := fs.Stat(s.wordbooks, file+".gz"); err == nil {
+			return file + ".gz"
+		}
+	}
+	return file
+}
+
+// isWordbookFile reports whether a file name has a wordbook extension,
+// .txt or the gzip-compressed .txt.gz.
+func isWordbookFile(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".txt") || strings.HasSuffix(lower, ".txt.gz")
+}
+
+func isGzipFile(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".gz")
+}
+
+// readWordbookFile returns the contents of a wordbook file, decompressing
+// it when the name ends in .gz.
+func readWordbookFile(fsys fs.FS, file string) ([]byte, error) {
+	if !isGzipFile(file) {
+		return fs.ReadFile(fsys, file)
+	}
+	f, err := fsys.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// listWordbooks returns the names of all .txt and .txt.gz files in fsys,
+// including those in subdirectories as slash-separated relative paths such
+// as "toefl/week1". Hidden directories are skipped.
+func listWordbooks(fsys fs.FS) ([]string, error) {
+	books := make([]string, 0)
+	err := fs.WalkDir(fsys, ".", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if p != "." && strings.HasPrefix(entry.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		name := entry.Name()
+		if !isWordbookFile(name) {
+			return nil
+		}
+		if isGzipFile(name) {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		base = strings.TrimSpace(base)
+		if base == "" || strings.HasSuffix(base, ".freq") {
+			return nil
+		}
+		books = append(books, path.Join(path.Dir(p), base))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortWordbookNames(books, lexicalLess)
+	// A wordbook stored both plain and compressed is listed once.
+	return slices.Compact(books), nil
+}
+
+// sortWordbookNames sorts names so that wordbooks in the same directory are
+// grouped together, with top-level wordbooks first. Directories and names
+// are ordered by less.
+func sortWordbookNames(names []string, less func(a, b string) bool) {
+	sort.Slice(names, func(i, j int) bool {
+		di, dj := path.Dir(names[i]), path.Dir(names[j])
+		if di != dj {
+			if di == "." || dj == "." {
+				return di == "."
+			}
+			return less(di, dj)
+		}
+		return less(names[i], names[j])
+	})
+}
+
+func lexicalLess(a, b string) bool {
+	return a < b
+}
+
+func readWordbook(fsys fs.FS, file, sep string) ([]string, error) {
+	data, err := readWordbookFile(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	return parseWordbook(data, sep), nil
+}
+
+// parseWordbook returns the normalized words of wordbook text whose lines
+// may carry a definition after sep.
+func parseWordbook(data []byte, sep string) []string {
+	lines := splitWordbookLines(data)
+	for i, line := range lines {
+		lines[i] = wordField(line, sep)
+	}
+	return normalizeWords(lines)
+}
+
+// readWordbookEntries reads a wordbook whose lines may carry a definition
+// after sep, as in "word\tdefinition". Lines without sep get an empty
+// definition.
+func readWordbookEntries(fsys fs.FS, file, sep string) ([]wordEntry, error) {
+	lines, err := readWordbookLines(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]wordEntry, 0, len(lines))
+	for _, line := range lines {
+		word, definition, _ := strings.Cut(line, sep)
+		word = normalizeWord(word)
+		if word == "" {
+			continue
+		}
+		entries = append(entries, wordEntry{Word: word, Definition: strings.TrimSpace(definition)})
+	}
+	return entries, nil
+}
+
+// wordField returns the word part of a wordbook line, dropping any
+// definition after sep.
+func wordField(line, sep string) string {
+	word, _, _ := strings.Cut(line, sep)
+	return word
+}
+
+// readWordbookPreservingCase reads a wordbook like readWordbook but keeps
+// the original casing of each word.
+func readWordbookPreservingCase(fsys fs.FS, file, sep string) ([]string, error) {
+	lines, err := readWordbookLines(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]string, 0, len(lines))
+	for _, line := range lines {
+		w := norm.NFC.String(strings.TrimSpace(wordField(line, sep)))
+		if w == "" {
+			continue
+		}
+		words = append(words, w)
+	}
+	return words, nil
+}
+
+// readWordbookLines returns the lines of a wordbook file with comments
+// removed. A "#" starts a comment that runs to the end of the line unless it
+// is escaped as "\#".
+func readWordbookLines(fsys fs.FS, file string) ([]string, error) {
+	data, err := readWordbookFile(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	return splitWordbookLines(data), nil
+}
+
+// splitWordbookLines splits wordbook text into lines with comments removed.
+func splitWordbookLines(data []byte) []string {
+	// Files saved on Windows may start with a byte order mark and end
+	// lines with \r\n.
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = stripComment(strings.TrimSuffix(line, "\r"))
+	}
+	return lines
+}
+
+func stripComment(line string) string {
+	if !strings.Contains(line, "#") {
+		return line
+	}
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '#':
+			b.WriteByte('#')
+			i++
+		case line[i] == '#':
+			return b.String()
+		default:
+			b.WriteByte(line[i])
+		}
+	}
+	return b.String()
+}
+
+// cachedWords is a parsed wordbook together with the modification time of
+// the file it was read from, a set of its words for membership tests, and
+// its "#!" directives.
+type cachedWords struct {
+	modTime    time.Time
+	words      []string
+	set        map[string]bool
+	directives map[string]string
+}
+
+// getWords returns the words of the named wordbook, re-reading the file only
+// when its modification time differs from the cached copy. The returned
+// slice is shared and must not be modified.
+func (s *server) getWords(name string) ([]string, error) {
+	cached, err := s.cachedWordbook(name)
+	if err != nil {
+		return nil, err
+	}
+	return cached.words, nil
+}
+
+// cachedWordbook returns the cache entry of the named wordbook, refreshing
+// it when the file has changed.
+func (s *server) cachedWordbook(name string) (cachedWords, error) {
+	file := s.wordbookFile(name)
+	info, err := fs.Stat(s.wordbooks, file)
+	if err != nil {
+		return cachedWords{}, err
+	}
+	if v, ok := s.words.Load(file); ok {
+		if cached := v.(cachedWords); cached.modTime.Equal(info.ModTime()) {
+			return cached, nil
+		}
+	}
+
+	// Words and directives come from a single read, so that they always
+	// belong to the same version of the file.
+	start := time.Now()
+	data, err := readWordbookFile(s.wordbooks, file)
+	if err != nil {
+		return cachedWords{}, err
+	}
+	words := parseWordbook(data, s.fieldSep)
+	s.metrics.observeRead(time.Since(start))
+	set := make(map[string]bool, len(words))
+	for _, word := range words {
+		set[word] = true
+	}
+	directives := parseDirectives(data)
+	cached := cachedWords{modTime: info.ModTime(), words: words, set: set, directives: directives}
+	s.words.Store(file, cached)
+	return cached, nil
+}
+
+// readDurationBuckets are the upper bounds, in seconds, of the wordbook read
+// duration histogram.
+var readDurationBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// metrics counts requests and times wordbook reads for GET /metrics. A nil
+// *metrics records nothing.
+type metrics struct {
+	mu       sync.Mutex
+	requests uint64
+	// routes counts requests by the mux pattern that served them.
+	routes map[string]uint64
+	// errors counts 4xx and 5xx responses by status code.
+	errors map[int]uint64
+	// readBuckets counts wordbook reads per bucket of readDurationBuckets,
+	// with a final bucket for slower reads.
+	readBuckets []uint64
+	readSum     float64
+	readCount   uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		routes:      make(map[string]uint64),
+		errors:      make(map[int]uint64),
+		readBuckets: make([]uint64, len(readDurationBuckets)+1),
+	}
+}
+
+// count records every request passing to next by the route mux matches.
+func (m *metrics) count(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests++
+		m.routes[route]++
+		if rw.status >= 400 {
+			m.errors[rw.status]++
+		}
+	})
+}
+
+func (m *metrics) observeRead(d time.Duration) {
+	if m == nil {
 		return
 	}
-	wordbook := strings.TrimSpace(req.Wordbook)
-	if wordbook == "" || strings.Contains(wordbook, "/") || strings.Contains(wordbook, "\\") {
-		http.Error(w, "invalid wordbook", http.StatusBadRequest)
+	seconds := d.Seconds()
+	i, _ := slices.BinarySearch(readDurationBuckets, seconds)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readBuckets[i]++
+	m.readSum += seconds
+	m.readCount++
+}
+
+// handle writes the metrics in the Prometheus text exposition format.
+func (m *metrics) handle(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
 		return
 	}
 
-	cfg, err := loadConfigOptional(s.configPath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP words_rain_http_requests_total Total HTTP requests served.\n")
+	b.WriteString("# TYPE words_rain_http_requests_total counter\n")
+	fmt.Fprintf(&b, "words_rain_http_requests_total %d\n", m.requests)
+
+	b.WriteString("# HELP words_rain_http_route_requests_total HTTP requests served by route.\n")
+	b.WriteString("# TYPE words_rain_http_route_requests_total counter\n")
+	routes := make([]string, 0, len(m.routes))
+	for route := range m.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		fmt.Fprintf(&b, "words_rain_http_route_requests_total{route=\"%s\"} %d\n", labelValueEscaper.Replace(route), m.routes[route])
+	}
+
+	b.WriteString("# HELP words_rain_http_errors_total HTTP responses with a 4xx or 5xx status.\n")
+	b.WriteString("# TYPE words_rain_http_errors_total counter\n")
+	codes := make([]int, 0, len(m.errors))
+	for code := range m.errors {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "words_rain_http_errors_total{code=\"%d\"} %d\n", code, m.errors[code])
+	}
+
+	b.WriteString("# HELP words_rain_wordbook_read_duration_seconds Time to read and parse a wordbook file.\n")
+	b.WriteString("# TYPE words_rain_wordbook_read_duration_seconds histogram\n")
+	var cumulative uint64
+	for i, bound := range readDurationBuckets {
+		cumulative += m.readBuckets[i]
+		fmt.Fprintf(&b, "words_rain_wordbook_read_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(&b, "words_rain_wordbook_read_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.readCount)
+	fmt.Fprintf(&b, "words_rain_wordbook_read_duration_seconds_sum %s\n", strconv.FormatFloat(m.readSum, 'g', -1, 64))
+	fmt.Fprintf(&b, "words_rain_wordbook_read_duration_seconds_count %d\n", m.readCount)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// labelValueEscaper escapes a Prometheus label value.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// statsCache holds the last computed collection stats together with the key
+// describing the collection state they were computed from.
+type statsCache struct {
+	mu    sync.Mutex
+	key   string
+	stats statsResponse
+}
+
+func (c *statsCache) get(key string) (statsResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key == "" || c.key != key {
+		return statsResponse{}, false
+	}
+	return c.stats, true
+}
+
+func (c *statsCache) set(key string, stats statsResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = key
+	c.stats = stats
+}
+
+// eventBroker fans out server-sent event names to subscribed clients.
+type eventBroker struct {
+	mu     sync.Mutex
+	subs   map[chan string]bool
+	closed bool
+}
+
+func (b *eventBroker) subscribe() chan string {
+	ch := make(chan string, 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	if b.subs == nil {
+		b.subs = make(map[chan string]bool)
+	}
+	b.subs[ch] = true
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// publish sends event to every subscriber, dropping it for subscribers that
+// still have an undelivered event pending.
+func (b *eventBroker) publish(event string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// close disconnects all subscribers so that streaming handlers return.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
+
+// watchWordbooks calls onChange whenever files under any of dirs change,
+// until ctx is cancelled. Bursts of events are coalesced.
+func watchWordbooks(ctx context.Context, dirs []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range dirs {
+		if err := watchDirTree(watcher, dir); err != nil {
+			return err
+		}
+	}
+
+	const debounce = 200 * time.Millisecond
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchDirTree(watcher, event.Name); err != nil {
+						log.Printf("failed to watch %s: %v", event.Name, err)
+					}
+				}
+			}
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("wordbooks watcher error: %v", err)
+		case <-timer.C:
+			onChange()
+		}
+	}
+}
+
+// watchDirTree adds dir and all of its non-hidden subdirectories to watcher.
+func watchDirTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if p != dir && strings.HasPrefix(entry.Name(), ".") {
+			return fs.SkipDir
+		}
+		return watcher.Add(p)
+	})
+}
+
+// createWordbookFile writes words one per line to path, failing with an
+// os.IsExist error if the file is already present.
+func createWordbookFile(path string, words []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(formatWordbook(words)); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// writeFileAtomic writes data to path like replaceFile. An existing file
+// keeps its permissions; perm applies to a new one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return replaceFile(path, data, perm)
+}
+
+// replaceFile writes data to a temporary file in the same directory as path
+// and renames it into place with permissions perm, so readers never observe
+// a partial file.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
-		http.Error(w, "failed to read settings", http.StatusInternalServerError)
-		return
-	}
-	if cfg.Host == "" {
-		cfg.Host = "127.0.0.1"
+		return err
 	}
-	if cfg.Port == 0 {
-		cfg.Port = 8080
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
 	}
-	if cfg.WordbooksDir == "" {
-		cfg.WordbooksDir = s.wordbooksDir
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
-	if cfg.Host == "127.0.0.1" && cfg.Port == 8080 && cfg.WordbooksDir == s.wordbooksDir && cfg.Accent == "" && cfg.Wordbook == "" && !cfg.OpenBrowser {
-		cfg.OpenBrowser = true
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
-	if cfg.Accent == "" {
-		cfg.Accent = "en-US"
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
-	cfg.Wordbook = wordbook
+	return nil
+}
 
-	if err := writeConfig(s.configPath, cfg); err != nil {
-		http.Error(w, "failed to write settings", http.StatusInternalServerError)
-		return
+// formatWordbook renders words one per line, escaping "#" so that it is not
+// read back as a comment.
+func formatWordbook(words []string) string {
+	if len(words) == 0 {
+		return ""
 	}
-
-	writeJSON(w, settingsResponse{
-		Accent:   cfg.Accent,
-		Wordbook: cfg.Wordbook,
-	})
+	var b strings.Builder
+	for _, word := range words {
+		b.WriteString(strings.ReplaceAll(word, "#", "\\#"))
+		b.WriteByte('\n')
+	}
+	return b.String()
 }
 
-func listWordbooks(dir string) ([]string, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
+func normalizeWords(lines []string) []string {
+	words := make([]string, 0, len(lines))
+	for _, line := range lines {
+		w := normalizeWord(line)
+		if w == "" {
+			continue
+		}
+		words = append(words, w)
 	}
+	return words
+}
 
-	books := make([]string, 0)
-	for _, entry := range entries {
-		if entry.IsDir() {
+// dedupeWords returns words with later duplicates removed, keeping order.
+func dedupeWords(words []string) []string {
+	seen := make(map[string]bool, len(words))
+	unique := make([]string, 0, len(words))
+	for _, word := range words {
+		if seen[word] {
 			continue
 		}
-		name := entry.Name()
-		if !strings.HasSuffix(strings.ToLower(name), ".txt") {
+		seen[word] = true
+		unique = append(unique, word)
+	}
+	return unique
+}
+
+// normalizeWord trims, lowercases and NFC-normalizes s, so that visually
+// identical words such as precomposed and combining "café" compare equal.
+func normalizeWord(s string) string {
+	return norm.NFC.String(strings.TrimSpace(lowerCase(s)))
+}
+
+// lowerCase lowercases words for normalizeWord. WORDS_RAIN_LOCALE replaces
+// it at startup, see setWordLocale.
+var lowerCase = strings.ToLower
+
+// setWordLocale makes normalizeWord lowercase by the rules of tag, which
+// differ from the default for Turkish, Azerbaijani and Lithuanian.
+func setWordLocale(tag language.Tag) {
+	// A Caser must not be shared between goroutines, so make one per call.
+	lowerCase = func(s string) string { return cases.Lower(tag).String(s) }
+}
+
+// naturalLess compares strings treating runs of digits as numbers, so that
+// "week2" sorts before "week10".
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		ca, cb := a[0], b[0]
+		if isDigit(ca) && isDigit(cb) {
+			na, restA := splitDigits(a)
+			nb, restB := splitDigits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			a, b = restA, restB
 			continue
 		}
-		base := strings.TrimSuffix(name, filepath.Ext(name))
-		base = strings.TrimSpace(base)
-		if base == "" {
-			continue
+		if ca != cb {
+			return ca < cb
 		}
-		books = append(books, base)
+		a, b = a[1:], b[1:]
 	}
+	return len(a) < len(b)
+}
 
-	sort.Strings(books)
-	return books, nil
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
 }
 
-func readWordbook(path string) ([]string, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// splitDigits splits s after its leading run of ASCII digits.
+func splitDigits(s string) (digits, rest string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
 	}
+	return s[:i], s[i:]
+}
 
-	lines := strings.Split(string(data), "\n")
-	words := make([]string, 0, len(lines))
-	for _, line := range lines {
-		w := strings.TrimSpace(strings.ToLower(line))
-		if w == "" {
-			continue
-		}
-		words = append(words, w)
+// cleanWordbookName trims a wordbook name and reports whether it is safe to
+// resolve inside the wordbooks directory. Names may contain forward slashes
+// to address subdirectories, but never "." or ".." elements.
+func cleanWordbookName(raw string) (string, bool) {
+	name := strings.TrimSpace(raw)
+	if name == "" || strings.Contains(name, "\\") || !fs.ValidPath(name) {
+		return "", false
 	}
-	return words, nil
+	return name, true
 }
 
 func writeJSON(w http.ResponseWriter, v any) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONError answers with status and an {"error": message} body.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Del("Content-Length")
+	writeJSONStatus(w, status, errorResponse{Error: message})
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		http.Error(w, "failed to encode json", http.StatusInternalServerError)
 	}
@@ -364,27 +4891,87 @@ type appConfig struct {
 	OpenBrowser  bool
 	Accent       string
 	Wordbook     string
+	TLSCert      string
+	TLSKey       string
+	Accents      []string
+	CORSOrigin   string
+	AuthUser     string
+	AuthPass     string
+	WordPattern  string
+	// AllowedWordbooks, when set, are the only wordbooks served.
+	AllowedWordbooks []string
+	// Locale is a BCP 47 tag whose casing rules lowercase words.
+	Locale      string
+	Speed       float64
+	SessionSize int
+	Theme       string
+	// FieldSep is the word/definition separator as written in the config,
+	// where \t stands for a tab; see fieldSeparator.
+	FieldSep string
+	// Extra holds unrecognized KEY=VALUE lines in file order so that
+	// rewriting the config does not drop them.
+	Extra []configEntry
 }
 
+type configEntry struct {
+	Key   string
+	Value string
+}
+
+// defaultConfigPath returns ~/.config/words-rain/config.env, or config.json
+// in the same directory when only that file exists.
 func defaultConfigPath() (string, error) {
+	base, err := configBaseDir(runtime.GOOS)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "words-rain")
+	envPath := filepath.Join(dir, "config.env")
+	jsonPath := filepath.Join(dir, "config.json")
+	if _, err := os.Stat(envPath); os.IsNotExist(err) {
+		if _, err := os.Stat(jsonPath); err == nil {
+			return jsonPath, nil
+		}
+	}
+	return envPath, nil
+}
+
+// configBaseDir returns the directory holding per-user config on goos:
+// %AppData% on Windows, otherwise $XDG_CONFIG_HOME, falling back to
+// ~/.config. As the XDG spec requires, a relative $XDG_CONFIG_HOME is ignored.
+func configBaseDir(goos string) (string, error) {
+	if goos == "windows" {
+		if dir := os.Getenv("AppData"); dir != "" {
+			return dir, nil
+		}
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" && filepath.IsAbs(dir) {
+		return dir, nil
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", fmt.Errorf("failed to resolve user home: %w", err)
 	}
-	return filepath.Join(home, ".config", "words-rain", "config.env"), nil
+	return filepath.Join(home, ".config"), nil
 }
 
-func loadDefaultConfig() (appConfig, string, error) {
-	path, err := defaultConfigPath()
+// loadSettings reads the config file with the WORDS_RAIN_* environment
+// variables applied over it, as at startup. Handlers that write the config
+// back start from loadConfigOptional instead, so that values from the
+// environment are not persisted.
+func (s *server) loadSettings() (appConfig, error) {
+	cfg, err := loadConfigOptional(s.configPath)
 	if err != nil {
-		return appConfig{}, "", err
+		return appConfig{}, err
+	}
+	if err := applyEnvOverrides(&cfg); err != nil {
+		return appConfig{}, err
 	}
-	cfg, err := parseEnvConfig(path)
-	return cfg, path, err
+	return cfg, nil
 }
 
 func loadConfigOptional(path string) (appConfig, error) {
-	cfg, err := parseEnvConfig(path)
+	cfg, err := parseConfig(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return appConfig{}, nil
@@ -394,6 +4981,72 @@ func loadConfigOptional(path string) (appConfig, error) {
 	return cfg, nil
 }
 
+// parseConfig reads the config file at path in the format implied by its
+// extension.
+func parseConfig(path string) (appConfig, error) {
+	if isJSONConfig(path) {
+		return parseJSONConfig(path)
+	}
+	return parseEnvConfig(path)
+}
+
+// parseJSONConfig reads a config file holding a JSON object keyed like the
+// env format. Values may be strings, numbers or booleans, and lists such as
+// WORDS_RAIN_ACCENTS may also be arrays of strings.
+func parseJSONConfig(path string) (appConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return appConfig{}, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return appConfig{}, fmt.Errorf("invalid JSON config: %w", err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cfg := appConfig{}
+	for _, key := range keys {
+		value, err := jsonConfigValue(raw[key])
+		if err != nil {
+			return appConfig{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		known, err := cfg.set(key, value)
+		if err != nil {
+			return appConfig{}, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if !known {
+			cfg.Extra = append(cfg.Extra, configEntry{Key: key, Value: value})
+		}
+	}
+	return cfg, nil
+}
+
+// jsonConfigValue converts a JSON config value to its env format text.
+func jsonConfigValue(raw json.RawMessage) (string, error) {
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return strings.TrimSpace(str), nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return strings.Join(list, ","), nil
+	}
+	var scalar any
+	if err := json.Unmarshal(raw, &scalar); err != nil {
+		return "", err
+	}
+	switch scalar.(type) {
+	case float64, bool:
+		return string(raw), nil
+	}
+	return "", errors.New("expected a string, number, boolean or list of strings")
+}
+
 func parseEnvConfig(path string) (appConfig, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -416,27 +5069,12 @@ func parseEnvConfig(path string) (appConfig, error) {
 		}
 		key := strings.TrimSpace(parts[0])
 		value := strings.TrimSpace(parts[1])
-		switch key {
-		case "WORDS_RAIN_HOST":
-			cfg.Host = value
-		case "WORDS_RAIN_PORT":
-			p, err := strconv.Atoi(value)
-			if err != nil {
-				return appConfig{}, fmt.Errorf("invalid WORDS_RAIN_PORT at line %d: %w", lineNo, err)
-			}
-			cfg.Port = p
-		case "WORDS_RAIN_WORDBOOKS_DIR":
-			cfg.WordbooksDir = value
-		case "WORDS_RAIN_OPEN_BROWSER":
-			b, err := strconv.ParseBool(value)
-			if err != nil {
-				return appConfig{}, fmt.Errorf("invalid WORDS_RAIN_OPEN_BROWSER at line %d: %w", lineNo, err)
-			}
-			cfg.OpenBrowser = b
-		case "WORDS_RAIN_ACCENT":
-			cfg.Accent = value
-		case "WORDS_RAIN_WORDBOOK":
-			cfg.Wordbook = value
+		known, err := cfg.set(key, value)
+		if err != nil {
+			return appConfig{}, fmt.Errorf("invalid %s at line %d: %w", key, lineNo, err)
+		}
+		if !known {
+			cfg.Extra = append(cfg.Extra, configEntry{Key: key, Value: value})
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -445,22 +5083,408 @@ func parseEnvConfig(path string) (appConfig, error) {
 	return cfg, nil
 }
 
+// parseAccents parses a comma-separated list of accent tags.
+func parseAccents(value string) ([]string, error) {
+	accents := make([]string, 0)
+	for _, part := range strings.Split(value, ",") {
+		accent := strings.TrimSpace(part)
+		if accent == "" {
+			continue
+		}
+		accent, err := canonicalAccent(accent)
+		if err != nil {
+			return nil, err
+		}
+		accents = append(accents, accent)
+	}
+	return accents, nil
+}
+
+// parseWordbookNames parses a comma-separated list of wordbook names.
+func parseWordbookNames(value string) ([]string, error) {
+	names := make([]string, 0)
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		name, ok := cleanWordbookName(part)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a wordbook name", strings.TrimSpace(part))
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// allowedAccents returns the accents configured in cfg, or defaultAccents
+// when none are configured.
+func allowedAccents(cfg appConfig) []string {
+	if len(cfg.Accents) > 0 {
+		return cfg.Accents
+	}
+	return defaultAccents
+}
+
+// parseDirectives returns the "key: value" pairs of the "#!" directive lines
+// in wordbook text, such as "#! title: GRE Week 1". Keys are lowercased.
+// Other lines, including ordinary "#" comments, are ignored.
+func parseDirectives(data []byte) map[string]string {
+	var directives map[string]string
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	for _, line := range strings.Split(text, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), "#!")
+		if !ok {
+			continue
+		}
+		key, value, ok := strings.Cut(rest, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !ok || key == "" {
+			continue
+		}
+		if directives == nil {
+			directives = make(map[string]string)
+		}
+		directives[key] = strings.TrimSpace(value)
+	}
+	return directives
+}
+
+// mergeDirectives fills the title, description and tags that meta leaves
+// empty from the matching directives; tags are comma-separated.
+func mergeDirectives(meta wordbookMeta, directives map[string]string) wordbookMeta {
+	if meta.Title == "" {
+		meta.Title = directives["title"]
+	}
+	if meta.Description == "" {
+		meta.Description = directives["description"]
+	}
+	if len(meta.Tags) == 0 && directives["tags"] != "" {
+		for _, tag := range strings.Split(directives["tags"], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				meta.Tags = append(meta.Tags, tag)
+			}
+		}
+	}
+	return meta
+}
+
+// hasTags reports whether meta is tagged with every one of tags.
+func hasTags(meta wordbookMeta, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(meta.Tags, strings.TrimSpace(tag)) {
+			return false
+		}
+	}
+	return true
+}
+
+// readMeta loads wordbook metadata, returning empty metadata when the file
+// does not exist.
+func readMeta(fsys fs.FS, file string) (wordbookMeta, error) {
+	data, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return wordbookMeta{}, nil
+		}
+		return wordbookMeta{}, err
+	}
+	var meta wordbookMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return wordbookMeta{}, err
+	}
+	return meta, nil
+}
+
+// readProgress loads saved progress, returning the zero progress when none
+// has been saved yet.
+func readProgress(path string) (wordbookProgress, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return wordbookProgress{}, nil
+		}
+		return wordbookProgress{}, err
+	}
+	var progress wordbookProgress
+	if err := json.Unmarshal(data, &progress); err != nil {
+		return wordbookProgress{}, err
+	}
+	return progress, nil
+}
+
+func writeProgress(path string, progress wordbookProgress) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0o644)
+}
+
+// configKeys lists the WORDS_RAIN_* keys understood by appConfig.set.
+var configKeys = []string{
+	"WORDS_RAIN_HOST",
+	"WORDS_RAIN_PORT",
+	"WORDS_RAIN_WORDBOOKS_DIR",
+	"WORDS_RAIN_OPEN_BROWSER",
+	"WORDS_RAIN_ACCENT",
+	"WORDS_RAIN_WORDBOOK",
+	"WORDS_RAIN_ACCENTS",
+	"WORDS_RAIN_CORS_ORIGIN",
+	"WORDS_RAIN_AUTH_USER",
+	"WORDS_RAIN_AUTH_PASS",
+	"WORDS_RAIN_TLS_CERT",
+	"WORDS_RAIN_TLS_KEY",
+	"WORDS_RAIN_WORD_PATTERN",
+	"WORDS_RAIN_LOCALE",
+	"WORDS_RAIN_ALLOWED_WORDBOOKS",
+	"WORDS_RAIN_SPEED",
+	"WORDS_RAIN_SESSION_SIZE",
+	"WORDS_RAIN_THEME",
+	"WORDS_RAIN_FIELD_SEP",
+}
+
+// set assigns the config field named by key, reporting whether the key is
+// known.
+func (cfg *appConfig) set(key, value string) (bool, error) {
+	switch key {
+	case "WORDS_RAIN_HOST":
+		cfg.Host = value
+	case "WORDS_RAIN_PORT":
+		p, err := strconv.Atoi(value)
+		if err != nil {
+			return true, err
+		}
+		cfg.Port = p
+	case "WORDS_RAIN_WORDBOOKS_DIR":
+		cfg.WordbooksDir = value
+	case "WORDS_RAIN_OPEN_BROWSER":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return true, err
+		}
+		cfg.OpenBrowser = b
+	case "WORDS_RAIN_ACCENT":
+		cfg.Accent = value
+	case "WORDS_RAIN_WORDBOOK":
+		cfg.Wordbook = value
+	case "WORDS_RAIN_ACCENTS":
+		accents, err := parseAccents(value)
+		if err != nil {
+			return true, err
+		}
+		cfg.Accents = accents
+	case "WORDS_RAIN_CORS_ORIGIN":
+		cfg.CORSOrigin = value
+	case "WORDS_RAIN_AUTH_USER":
+		cfg.AuthUser = value
+	case "WORDS_RAIN_AUTH_PASS":
+		cfg.AuthPass = value
+	case "WORDS_RAIN_TLS_CERT":
+		cfg.TLSCert = value
+	case "WORDS_RAIN_TLS_KEY":
+		cfg.TLSKey = value
+	case "WORDS_RAIN_WORD_PATTERN":
+		if _, err := regexp.Compile(value); err != nil {
+			return true, err
+		}
+		cfg.WordPattern = value
+	case "WORDS_RAIN_LOCALE":
+		if _, err := language.Parse(value); err != nil {
+			return true, err
+		}
+		cfg.Locale = value
+	case "WORDS_RAIN_ALLOWED_WORDBOOKS":
+		names, err := parseWordbookNames(value)
+		if err != nil {
+			return true, err
+		}
+		cfg.AllowedWordbooks = names
+	case "WORDS_RAIN_SPEED":
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return true, err
+		}
+		if speed <= 0 {
+			return true, errors.New("must be greater than 0")
+		}
+		cfg.Speed = speed
+	case "WORDS_RAIN_SESSION_SIZE":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return true, err
+		}
+		if size < 1 {
+			return true, errors.New("must be at least 1")
+		}
+		cfg.SessionSize = size
+	case "WORDS_RAIN_THEME":
+		if !slices.Contains(themes, value) {
+			return true, fmt.Errorf("must be one of %s", strings.Join(themes, ", "))
+		}
+		cfg.Theme = value
+	case "WORDS_RAIN_FIELD_SEP":
+		if value == "" {
+			return true, errors.New("must not be empty")
+		}
+		cfg.FieldSep = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyEnvOverrides sets every config field whose WORDS_RAIN_* key is
+// present in the process environment.
+func applyEnvOverrides(cfg *appConfig) error {
+	for _, key := range configKeys {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if _, err := cfg.set(key, strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// fieldSeparator returns the word/definition separator configured by
+// WORDS_RAIN_FIELD_SEP, defaulting to a tab. The config value \t also means
+// a tab, since surrounding whitespace is trimmed from config values.
+func fieldSeparator(cfg appConfig) string {
+	if cfg.FieldSep == "" || cfg.FieldSep == `\t` {
+		return "\t"
+	}
+	return cfg.FieldSep
+}
+
+// configValue is one setting of a config file with its typed value.
+type configValue struct {
+	Key   string
+	Value any
+}
+
+// configValues lists the settings of cfg to write: the core keys always,
+// optional keys only when set, then the unrecognized entries.
+func configValues(cfg appConfig) []configValue {
+	values := []configValue{
+		{"WORDS_RAIN_HOST", cfg.Host},
+		{"WORDS_RAIN_PORT", cfg.Port},
+		{"WORDS_RAIN_OPEN_BROWSER", cfg.OpenBrowser},
+		{"WORDS_RAIN_WORDBOOKS_DIR", cfg.WordbooksDir},
+		{"WORDS_RAIN_ACCENT", cfg.Accent},
+		{"WORDS_RAIN_WORDBOOK", cfg.Wordbook},
+	}
+	if len(cfg.Accents) > 0 {
+		values = append(values, configValue{"WORDS_RAIN_ACCENTS", cfg.Accents})
+	}
+	if cfg.CORSOrigin != "" {
+		values = append(values, configValue{"WORDS_RAIN_CORS_ORIGIN", cfg.CORSOrigin})
+	}
+	if cfg.AuthUser != "" {
+		values = append(values, configValue{"WORDS_RAIN_AUTH_USER", cfg.AuthUser})
+	}
+	if cfg.AuthPass != "" {
+		values = append(values, configValue{"WORDS_RAIN_AUTH_PASS", cfg.AuthPass})
+	}
+	if cfg.TLSCert != "" {
+		values = append(values, configValue{"WORDS_RAIN_TLS_CERT", cfg.TLSCert})
+	}
+	if cfg.TLSKey != "" {
+		values = append(values, configValue{"WORDS_RAIN_TLS_KEY", cfg.TLSKey})
+	}
+	if cfg.WordPattern != "" {
+		values = append(values, configValue{"WORDS_RAIN_WORD_PATTERN", cfg.WordPattern})
+	}
+	if cfg.Locale != "" {
+		values = append(values, configValue{"WORDS_RAIN_LOCALE", cfg.Locale})
+	}
+	if len(cfg.AllowedWordbooks) > 0 {
+		values = append(values, configValue{"WORDS_RAIN_ALLOWED_WORDBOOKS", cfg.AllowedWordbooks})
+	}
+	if cfg.Speed > 0 {
+		values = append(values, configValue{"WORDS_RAIN_SPEED", cfg.Speed})
+	}
+	if cfg.SessionSize > 0 {
+		values = append(values, configValue{"WORDS_RAIN_SESSION_SIZE", cfg.SessionSize})
+	}
+	if cfg.Theme != "" {
+		values = append(values, configValue{"WORDS_RAIN_THEME", cfg.Theme})
+	}
+	if cfg.FieldSep != "" {
+		values = append(values, configValue{"WORDS_RAIN_FIELD_SEP", cfg.FieldSep})
+	}
+	for _, entry := range cfg.Extra {
+		values = append(values, configValue{entry.Key, entry.Value})
+	}
+	return values
+}
+
+// writeConfig writes cfg in the format implied by the extension of path:
+// JSON for .json files, KEY=VALUE lines otherwise.
 func writeConfig(path string, cfg appConfig) error {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return err
 	}
+	if isJSONConfig(path) {
+		return writeJSONConfig(path, cfg)
+	}
+
+	lines := []string{"# words-rain default config"}
+	for _, v := range configValues(cfg) {
+		value := fmt.Sprint(v.Value)
+		if list, ok := v.Value.([]string); ok {
+			value = strings.Join(list, ",")
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s", v.Key, value))
+	}
+	content := strings.Join(append(lines, ""), "\n")
+	return replaceFile(path, []byte(content), configFileMode(path, cfg))
+}
+
+// configFileMode returns the permissions to write the config file at path
+// with: those of the existing file, or 0644 for a new one, with group and
+// other access removed when cfg holds auth credentials.
+func configFileMode(path string, cfg appConfig) os.FileMode {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if cfg.AuthUser != "" || cfg.AuthPass != "" {
+		mode &^= 0o077
+	}
+	return mode
+}
+
+// writeJSONConfig writes cfg as a JSON object keyed like the env format,
+// keeping the key order of configValues.
+func writeJSONConfig(path string, cfg appConfig) error {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, v := range configValues(cfg) {
+		key, err := json.Marshal(v.Key)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(v.Value)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "\n  %s: %s", key, value)
+	}
+	b.WriteString("\n}\n")
+	return replaceFile(path, []byte(b.String()), configFileMode(path, cfg))
+}
 
-	content := strings.Join([]string{
-		"# words-rain default config",
-		fmt.Sprintf("WORDS_RAIN_HOST=%s", cfg.Host),
-		fmt.Sprintf("WORDS_RAIN_PORT=%d", cfg.Port),
-		fmt.Sprintf("WORDS_RAIN_OPEN_BROWSER=%t", cfg.OpenBrowser),
-		fmt.Sprintf("WORDS_RAIN_WORDBOOKS_DIR=%s", cfg.WordbooksDir),
-		fmt.Sprintf("WORDS_RAIN_ACCENT=%s", cfg.Accent),
-		fmt.Sprintf("WORDS_RAIN_WORDBOOK=%s", cfg.Wordbook),
-		"",
-	}, "\n")
-	return os.WriteFile(path, []byte(content), 0o644)
+// isJSONConfig reports whether the config file at path uses the JSON format.
+func isJSONConfig(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
 }
 
 func browserHost(host string) string {
@@ -474,15 +5498,43 @@ func browserHost(host string) string {
 	return h
 }
 
+// browserURL returns the address at which the browser finds the UI of a
+// server listening on host and port. JoinHostPort brackets IPv6 literals, as
+// in http://[::1]:8080/.
+func browserURL(scheme, host string, port int, basePath string) string {
+	return fmt.Sprintf("%s://%s%s/", scheme, net.JoinHostPort(browserHost(host), strconv.Itoa(port)), basePath)
+}
+
 func openBrowserURL(target string) error {
-	var cmd *exec.Cmd
-	switch runtime.GOOS {
+	args := browserCommand(runtime.GOOS, isWSL(), exec.LookPath, target)
+	return exec.Command(args[0], args[1:]...).Start()
+}
+
+// browserCommand returns the command line that opens target in the default
+// browser on goos, looking up optional helpers with lookPath.
+func browserCommand(goos string, wsl bool, lookPath func(string) (string, error), target string) []string {
+	switch goos {
 	case "darwin":
-		cmd = exec.Command("open", target)
+		return []string{"open", target}
 	case "windows":
-		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
-	default:
-		cmd = exec.Command("xdg-open", target)
+		return []string{"rundll32", "url.dll,FileProtocolHandler", target}
+	}
+	if !wsl {
+		return []string{"xdg-open", target}
+	}
+	if _, err := lookPath("wslview"); err == nil {
+		return []string{"wslview", target}
+	}
+	// Quote the URL so PowerShell does not split it at & or ;.
+	return []string{"powershell.exe", "-NoProfile", "-Command", "Start-Process", "'" + strings.ReplaceAll(target, "'", "''") + "'"}
+}
+
+// isWSL reports whether the process runs under the Windows Subsystem for
+// Linux, where xdg-open is usually missing.
+func isWSL() bool {
+	data, err := os.ReadFile("/proc/version")
+	if err != nil {
+		return false
 	}
-	return cmd.Start()
+	return strings.Contains(strings.ToLower(string(data)), "microsoft")
 }
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestServer returns a server over a temporary wordbooks directory
+// holding books, keyed by wordbook name, and a temporary config file.
+func newTestServer(t *testing.T, books map[string]string) *server {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range books {
+		path := filepath.Join(dir, filepath.FromSlash(name)+".txt")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &server{
+		wordbooksDir:  dir,
+		wordbooksDirs: []string{dir},
+		wordbooks:     os.DirFS(dir),
+		configPath:    filepath.Join(t.TempDir(), "config.env"),
+		fieldSep:      "\t",
+	}
+}
+
+func TestConcurrentSettingsUpdates(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\n", "beta": "two\n"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, "/api/settings/accent", strings.NewReader(`{"accent":"en-GB"}`))
+			rec := httptest.NewRecorder()
+			s.handleSettingsAccent(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("accent update: status %d: %s", rec.Code, rec.Body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, "/api/settings/wordbook", strings.NewReader(`{"wordbook":"beta"}`))
+			rec := httptest.NewRecorder()
+			s.handleSettingsWordbook(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Errorf("wordbook update: status %d: %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	s.handleSettings(rec, httptest.NewRequest(http.MethodGet, "/api/settings", nil))
+	var got settingsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Accent != "en-GB" || got.Wordbook != "beta" {
+		t.Errorf("settings = accent %q, wordbook %q; want en-GB and beta", got.Accent, got.Wordbook)
+	}
+}
+
+func TestValidateListenAddr(t *testing.T) {
+	tests := []struct {
+		host    string
+		port    int
+		wantErr bool
+	}{
+		{"127.0.0.1", 8080, false},
+		{"", 8080, false},
+		{"::1", 8080, false},
+		{"localhost", 1, false},
+		{"words.example.com", 65535, false},
+		{"127.0.0.1", 0, true},
+		{"127.0.0.1", -1, true},
+		{"127.0.0.1", 65536, true},
+		{"bad_host", 8080, true},
+		{"-leading.example.com", 8080, true},
+		{strings.Repeat("a.", 127) + "a", 8080, true},
+	}
+	for _, tt := range tests {
+		err := validateListenAddr(tt.host, tt.port)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateListenAddr(%q, %d) = %v, want error %v", tt.host, tt.port, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWithGzip(t *testing.T) {
+	body := strings.Repeat("words rain ", 200)
+	handler := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/wordbooks", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Errorf("decompressed body differs: got %d bytes, want %d", len(data), len(body))
+	}
+
+	// Without Accept-Encoding the body is sent as is.
+	req = httptest.NewRequest(http.MethodGet, "/api/wordbooks", nil)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q without Accept-Encoding", got)
+	}
+	if rec.Body.String() != body {
+		t.Error("uncompressed body differs")
+	}
+}
+
+func TestWithGzipPanic(t *testing.T) {
+	serve := func(size int) (rec *httptest.ResponseRecorder, aborted bool) {
+		handler := withRecovery(withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, strings.Repeat("x", size))
+			panic("boom")
+		})))
+		req := httptest.NewRequest(http.MethodGet, "/api/wordbooks", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec = httptest.NewRecorder()
+		defer func() {
+			if err := recover(); err != nil {
+				if err != http.ErrAbortHandler {
+					panic(err)
+				}
+				aborted = true
+			}
+		}()
+		handler.ServeHTTP(rec, req)
+		return rec, false
+	}
+
+	// A panic while the body is still buffered becomes a clean 500.
+	rec, aborted := serve(10)
+	if aborted || rec.Code != http.StatusInternalServerError {
+		t.Errorf("buffered panic: status %d, aborted %v; want 500", rec.Code, aborted)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("buffered panic: Content-Encoding = %q", got)
+	}
+	if !strings.Contains(rec.Body.String(), "internal server error") || strings.Contains(rec.Body.String(), "x") {
+		t.Errorf("buffered panic: body %q, want only the error", rec.Body)
+	}
+
+	// Once the compressed response has started, the connection is aborted.
+	if _, aborted := serve(gzipMinSize * 2); !aborted {
+		t.Error("panic after the response started did not abort it")
+	}
+}
+
+func TestNormalizeWordUnicode(t *testing.T) {
+	composed := "café"
+	decomposed := "café"
+	if got := normalizeWord(decomposed); got != composed {
+		t.Errorf("normalizeWord(%q) = %q, want %q", decomposed, got, composed)
+	}
+	if got := normalizeWord(" CAFÉ "); got != composed {
+		t.Errorf("normalizeWord of upper-case NFD = %q, want %q", got, composed)
+	}
+
+	got := dedupeWords(normalizeWords([]string{composed, decomposed, "Café", "tea"}))
+	want := []string{composed, "tea"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("dedupeWords = %q, want %q", got, want)
+	}
+}
+
+func TestReadWordbookLinesWindowsFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"win.txt": {Data: []byte("\ufeffapple\r\nbanana # fruit\r\n\r\ncherry\r\n")},
+	}
+	lines, err := readWordbookLines(fsys, "win.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := normalizeWords(lines)
+	want := []string{"apple", "banana", "cherry"}
+	if strings.Join(words, ",") != strings.Join(want, ",") {
+		t.Errorf("words = %q, want %q", words, want)
+	}
+	for _, line := range lines {
+		if strings.ContainsAny(line, "\r\ufeff") {
+			t.Errorf("line %q keeps a carriage return or byte order mark", line)
+		}
+	}
+}
+
+func TestBrowserURL(t *testing.T) {
+	tests := []struct {
+		host     string
+		port     int
+		basePath string
+		want     string
+	}{
+		{"127.0.0.1", 8080, "", "http://127.0.0.1:8080/"},
+		{"", 8080, "", "http://127.0.0.1:8080/"},
+		{"0.0.0.0", 8080, "", "http://127.0.0.1:8080/"},
+		{"::", 8080, "", "http://127.0.0.1:8080/"},
+		{"localhost", 9000, "/words-rain", "http://localhost:9000/words-rain/"},
+		{"::1", 8080, "", "http://[::1]:8080/"},
+		{"fe80::1", 8080, "", "http://[fe80::1]:8080/"},
+	}
+	for _, tt := range tests {
+		got := browserURL("http", tt.host, tt.port, tt.basePath)
+		if got != tt.want {
+			t.Errorf("browserURL(%q, %d, %q) = %q, want %q", tt.host, tt.port, tt.basePath, got, tt.want)
+		}
+		if _, err := url.Parse(got); err != nil {
+			t.Errorf("browserURL(%q) = %q does not parse: %v", tt.host, got, err)
+		}
+	}
+}
+
+func TestWordbooksTrailingSlash(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\n", "toefl/week1": "two\n"})
+
+	rec := httptest.NewRecorder()
+	s.handleWordbooks(rec, httptest.NewRequest(http.MethodGet, "/api/wordbooks", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/wordbooks: status %d: %s", rec.Code, rec.Body)
+	}
+	want := rec.Body.String()
+
+	rec = httptest.NewRecorder()
+	s.handleWordbook(rec, httptest.NewRequest(http.MethodGet, "/api/wordbooks/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/wordbooks/: status %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Body.String(); got != want {
+		t.Errorf("GET /api/wordbooks/ = %s, want %s", got, want)
+	}
+	if !strings.Contains(want, `"toefl/week1"`) {
+		t.Errorf("listing %s lacks toefl/week1", want)
+	}
+}
+
+func TestBrowserCommand(t *testing.T) {
+	found := func(string) (string, error) { return "/usr/bin/wslview", nil }
+	missing := func(name string) (string, error) { return "", &exec.Error{Name: name, Err: exec.ErrNotFound} }
+	const target = "http://127.0.0.1:8080/?a=1&b='2'"
+	tests := []struct {
+		goos     string
+		wsl      bool
+		lookPath func(string) (string, error)
+		want     []string
+	}{
+		{"darwin", false, missing, []string{"open", target}},
+		{"windows", false, missing, []string{"rundll32", "url.dll,FileProtocolHandler", target}},
+		{"linux", false, found, []string{"xdg-open", target}},
+		{"linux", true, found, []string{"wslview", target}},
+		{"linux", true, missing, []string{"powershell.exe", "-NoProfile", "-Command", "Start-Process", "'http://127.0.0.1:8080/?a=1&b=''2'''"}},
+	}
+	for _, tt := range tests {
+		got := browserCommand(tt.goos, tt.wsl, tt.lookPath, target)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("browserCommand(%q, wsl %v) = %q, want %q", tt.goos, tt.wsl, got, tt.want)
+		}
+	}
+}
+
+func TestConfigBaseDir(t *testing.T) {
+	home := t.TempDir()
+	xdg := t.TempDir()
+	appData := t.TempDir()
+	tests := []struct {
+		goos    string
+		xdg     string
+		appData string
+		want    string
+	}{
+		{"linux", xdg, "", xdg},
+		{"linux", "", "", filepath.Join(home, ".config")},
+		{"linux", "relative/config", "", filepath.Join(home, ".config")},
+		{"darwin", xdg, appData, xdg},
+		{"windows", xdg, appData, appData},
+		{"windows", xdg, "", xdg},
+	}
+	for _, tt := range tests {
+		t.Setenv("HOME", home)
+		t.Setenv("USERPROFILE", home)
+		t.Setenv("XDG_CONFIG_HOME", tt.xdg)
+		t.Setenv("AppData", tt.appData)
+		got, err := configBaseDir(tt.goos)
+		if err != nil {
+			t.Fatalf("configBaseDir(%q): %v", tt.goos, err)
+		}
+		if got != tt.want {
+			t.Errorf("configBaseDir(%q) with XDG_CONFIG_HOME=%q AppData=%q = %q, want %q", tt.goos, tt.xdg, tt.appData, got, tt.want)
+		}
+	}
+}
+
+func TestWithCacheControl(t *testing.T) {
+	staticFS := fstest.MapFS{
+		"index.html": {Data: []byte(`<head><script src="app.js"></script></head>`)},
+		"app.js":     {Data: []byte("console.log(1)")},
+	}
+	handler := withCacheControl(time.Hour, withIndexPage("", staticFS, http.FileServer(http.FS(staticFS))))
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	page := get("/")
+	if got := page.Header().Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("page Cache-Control = %q, want no-cache", got)
+	}
+	sum := sha256.Sum256(staticFS["app.js"].Data)
+	versioned := "app.js?v=" + hex.EncodeToString(sum[:4])
+	if !strings.Contains(page.Body.String(), `"`+versioned+`"`) {
+		t.Errorf("page %s does not refer to %s", page.Body, versioned)
+	}
+
+	tests := []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/" + versioned, http.StatusOK, "public, max-age=3600"},
+		{"/app.js", http.StatusOK, "no-cache"},
+		{"/missing.js?v=1", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := get(tt.target)
+		if rec.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.target, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("GET %s: Cache-Control = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAppendRefreshesCachedWords(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\n"})
+	get := func() string {
+		rec := httptest.NewRecorder()
+		s.handleWordbook(rec, httptest.NewRequest(http.MethodGet, "/api/wordbooks/alpha", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET: status %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	get()
+	rec := httptest.NewRecorder()
+	s.handleWordbook(rec, httptest.NewRequest(http.MethodPatch, "/api/wordbooks/alpha", strings.NewReader(`{"words":["two"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH: status %d: %s", rec.Code, rec.Body)
+	}
+	if body := get(); !strings.Contains(body, `"two"`) {
+		t.Errorf("GET after append = %s, want it to include two", body)
+	}
+}
+
+func TestRenameAndDeleteMoveProgress(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\ntwo\n"})
+	if err := writeProgress(s.progressPath("alpha"), wordbookProgress{Index: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleWordbook(rec, httptest.NewRequest(http.MethodPost, "/api/wordbooks/alpha/rename", strings.NewReader(`{"newName":"toefl/beta"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("rename: status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(s.progressPath("alpha")); !os.IsNotExist(err) {
+		t.Errorf("progress of the old name still exists: %v", err)
+	}
+	progress, err := readProgress(s.progressPath("toefl/beta"))
+	if err != nil || progress.Index != 1 {
+		t.Errorf("progress of the new name = %+v, %v; want index 1", progress, err)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleWordbook(rec, httptest.NewRequest(http.MethodDelete, "/api/wordbooks/toefl/beta", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(s.progressPath("toefl/beta")); !os.IsNotExist(err) {
+		t.Errorf("progress of the deleted wordbook still exists: %v", err)
+	}
+}
+
+func TestWordbookWordsETag(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\ntwo\nthree\n"})
+	get := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		s.handleWordbook(rec, req)
+		return rec
+	}
+
+	first := get("/api/wordbooks/alpha", "")
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatalf("ETag %q, Cache-Control %q; want an ETag and no-cache", etag, first.Header().Get("Cache-Control"))
+	}
+	if rec := get("/api/wordbooks/alpha", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("same request: status %d, want 304", rec.Code)
+	}
+	if rec := get("/api/wordbooks/alpha?limit=1", etag); rec.Code != http.StatusOK {
+		t.Errorf("other query: status %d, want 200", rec.Code)
+	}
+	if rec := get("/api/wordbooks/alpha?accent=en-GB", etag); rec.Code != http.StatusOK {
+		t.Errorf("other accent: status %d, want 200", rec.Code)
+	}
+	rec := get("/api/wordbooks/alpha?shuffle=true", "")
+	if rec.Header().Get("ETag") != "" || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("unseeded shuffle: ETag %q, Cache-Control %q; want no ETag and no-store", rec.Header().Get("ETag"), rec.Header().Get("Cache-Control"))
+	}
+	if rec := get("/api/wordbooks/alpha?shuffle=true&seed=1", ""); rec.Header().Get("ETag") == "" {
+		t.Error("seeded shuffle has no ETag")
+	}
+}
+
+func TestConfigReportsCurrentSettings(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\n"})
+	if err := os.WriteFile(s.configPath, []byte("WORDS_RAIN_ACCENT=en-US\nOTHER_TOOL_TOKEN=secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleSettingsWordbook(rec, httptest.NewRequest(http.MethodPut, "/api/settings/wordbook", strings.NewReader(`{"wordbook":"alpha"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wordbook update: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleConfig(rec, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	var got configResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Config["WORDS_RAIN_WORDBOOK"] != "alpha" {
+		t.Errorf("WORDS_RAIN_WORDBOOK = %v, want alpha", got.Config["WORDS_RAIN_WORDBOOK"])
+	}
+	if got.Config["OTHER_TOOL_TOKEN"] != "[redacted]" {
+		t.Errorf("OTHER_TOOL_TOKEN = %v, want it redacted", got.Config["OTHER_TOOL_TOKEN"])
+	}
+}
+
+func TestWriteConfigModeWithAuth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows files have no Unix permissions")
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"config.env", "config.json"} {
+		path := filepath.Join(dir, name)
+		if err := writeConfig(path, appConfig{AuthUser: "kiosk", AuthPass: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm&0o077 != 0 {
+			t.Errorf("%s with credentials has mode %v, want no group or other access", name, perm)
+		}
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := memFS{name: "stdin.txt", data: []byte("apple\nbanana\n"), modTime: time.Now()}
+	if err := fstest.TestFS(fsys, "stdin.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPaginateWords(t *testing.T) {
+	words := make([]string, defaultWordsPageLimit+20)
+	for i := range words {
+		words[i] = strconv.Itoa(i)
+	}
+	tests := []struct {
+		query     string
+		wantLen   int
+		wantFirst string
+	}{
+		{"", defaultWordsPageLimit, "0"},
+		{"offset=500", 20, "500"},
+		{"limit=10", 10, "0"},
+		{"offset=5&limit=3", 3, "5"},
+		{"offset=10000", 0, ""},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		got, err := paginateWords(q, words)
+		if err != nil {
+			t.Fatalf("paginateWords(%q): %v", tt.query, err)
+		}
+		first := ""
+		if len(got) > 0 {
+			first = got[0]
+		}
+		if len(got) != tt.wantLen || first != tt.wantFirst {
+			t.Errorf("paginateWords(%q) = %d words from %q, want %d from %q", tt.query, len(got), first, tt.wantLen, tt.wantFirst)
+		}
+	}
+	for _, query := range []string{"offset=-1", "limit=0", "limit=x"} {
+		q, _ := url.ParseQuery(query)
+		if _, err := paginateWords(q, words); err == nil {
+			t.Errorf("paginateWords(%q) succeeded, want an error", query)
+		}
+	}
+}
+
+func TestWordbookWordsLastModified(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\ntwo\n"})
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/wordbooks/alpha", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		s.handleWordbook(rec, req)
+		return rec
+	}
+
+	first := get("", "")
+	lastModified := first.Header().Get("Last-Modified")
+	if lastModified == "" || first.Header().Get("ETag") == "" {
+		t.Fatalf("Last-Modified %q, ETag %q; want both", lastModified, first.Header().Get("ETag"))
+	}
+	if rec := get("If-Modified-Since", lastModified); rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since the file time: status %d, want 304", rec.Code)
+	}
+	if rec := get("If-Modified-Since", time.Unix(0, 0).UTC().Format(http.TimeFormat)); rec.Code != http.StatusOK {
+		t.Errorf("If-Modified-Since an older time: status %d, want 200", rec.Code)
+	}
+
+	// A frequency file only present compressed still changes the ETag.
+	path := filepath.Join(s.wordbooksDir, "alpha.freq.txt.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	io.WriteString(zw, "two\none\n")
+	zw.Close()
+	f.Close()
+	if rec := get("If-None-Match", first.Header().Get("ETag")); rec.Code != http.StatusOK {
+		t.Errorf("after adding alpha.freq.txt.gz: status %d, want 200", rec.Code)
+	}
+}
+
+func TestStdinWordbookReadOnly(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\n"})
+	s.wordbooks = layeredFS{
+		upper: memFS{name: stdinWordbook + ".txt", data: []byte("piped\nwords\n"), modTime: time.Now()},
+		lower: s.wordbooks,
+	}
+	s.stdin = true
+
+	tests := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPatch, "/api/wordbooks/stdin", `{"words":["more"]}`, http.StatusForbidden},
+		{http.MethodDelete, "/api/wordbooks/stdin", "", http.StatusForbidden},
+		{http.MethodPost, "/api/wordbooks/stdin/normalize", "", http.StatusForbidden},
+		{http.MethodPost, "/api/wordbooks/stdin/rename", `{"newName":"piped"}`, http.StatusForbidden},
+		{http.MethodPut, "/api/wordbooks/stdin/meta", `{"title":"Piped"}`, http.StatusForbidden},
+		{http.MethodPost, "/api/wordbooks/alpha/rename", `{"newName":"stdin"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.handleWordbook(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d: %s", tt.method, tt.target, rec.Code, tt.want, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleWordbooks(rec, httptest.NewRequest(http.MethodPost, "/api/wordbooks", strings.NewReader(`{"name":"stdin","words":["a"]}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("creating stdin: status %d, want 409: %s", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.wordbooksDir, "stdin.txt")); !os.IsNotExist(err) {
+		t.Errorf("stdin.txt was written: %v", err)
+	}
+}
+
+// countingFS counts the files opened, but not those merely stat'ed, in FS.
+type countingFS struct {
+	fs.FS
+	opens map[string]int
+}
+
+func (c countingFS) Open(name string) (fs.File, error) {
+	c.opens[name]++
+	return c.FS.Open(name)
+}
+
+func (c countingFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(c.FS, name)
+}
+
+func TestCachedWordbookReadsOnce(t *testing.T) {
+	fsys := countingFS{
+		FS:    fstest.MapFS{"week1.txt": {Data: []byte("#! title: Week 1\napple\nbanana\n")}},
+		opens: make(map[string]int),
+	}
+	s := &server{wordbooks: fsys, fieldSep: "\t"}
+
+	cached, err := s.cachedWordbook("week1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cached.words, ",") != "apple,banana" || cached.directives["title"] != "Week 1" {
+		t.Errorf("cached = words %q, directives %v", cached.words, cached.directives)
+	}
+	if n := fsys.opens["week1.txt"]; n != 1 {
+		t.Errorf("week1.txt read %d times, want once", n)
+	}
+}
+
+func TestStepWordbook(t *testing.T) {
+	s := newTestServer(t, map[string]string{"alpha": "one\n", "beta": "two\n", "gamma": "three\n"})
+	next, previous := s.stepWordbook(1), s.stepWordbook(-1)
+	steps := []struct {
+		handler http.Handler
+		method  string
+		want    string
+	}{
+		{next, http.MethodGet, "alpha"},
+		{next, http.MethodPost, "beta"},
+		{next, http.MethodGet, "gamma"},
+		{next, http.MethodPost, "alpha"},
+		{previous, http.MethodGet, "gamma"},
+		{previous, http.MethodPost, "beta"},
+	}
+	for i, step := range steps {
+		rec := httptest.NewRecorder()
+		step.handler.ServeHTTP(rec, httptest.NewRequest(step.method, "/api/settings/wordbook/next", nil))
+		var got settingsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("step %d: status %d: %v", i, rec.Code, err)
+		}
+		if rec.Code != http.StatusOK || got.Wordbook != step.want {
+			t.Errorf("step %d (%s): status %d, wordbook %q; want 200 and %q", i, step.method, rec.Code, got.Wordbook, step.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	next.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/settings/wordbook/next", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status %d, want 405", rec.Code)
+	}
+}
+
+func TestWritesKeepFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows files have no Unix permissions")
+	}
+	s := newTestServer(t, map[string]string{"alpha": "one\n"})
+	path := filepath.Join(s.wordbooksDir, "alpha.txt")
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleWordbook(rec, httptest.NewRequest(http.MethodPatch, "/api/wordbooks/alpha", strings.NewReader(`{"words":["two"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH: status %d: %s", rec.Code, rec.Body)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("wordbook mode after append = %v, want 0600", perm)
+	}
+
+	if err := os.WriteFile(s.configPath, nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(s.configPath, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConfig(s.configPath, appConfig{Accent: "en-GB"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.configPath); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0o640 {
+		t.Errorf("config mode after write = %v, want 0640", perm)
+	}
+
+	// Credentials still take group and other access away.
+	if err := writeConfig(s.configPath, appConfig{AuthUser: "kiosk", AuthPass: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(s.configPath); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("config mode with credentials = %v, want 0600", perm)
+	}
+}
+
+func TestFetchWordbook(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "one\ntwo\nthree\n")
+	}))
+	defer srv.Close()
+	s := newTestServer(t, nil)
+	s.importMaxBytes = 8
+
+	fetch := func() *httptest.ResponseRecorder {
+		body := `{"url":"` + srv.URL + `/words.txt","name":"fetched"}`
+		rec := httptest.NewRecorder()
+		s.handleFetchWordbook(rec, httptest.NewRequest(http.MethodPost, "/api/wordbooks/fetch", strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := fetch(); rec.Code != http.StatusForbidden {
+		t.Errorf("loopback url: status %d, want 403: %s", rec.Code, rec.Body)
+	}
+
+	// With the address check out of the way, the size limit applies.
+	s.fetchClient = srv.Client()
+	rec := fetch()
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "8 bytes") {
+		t.Errorf("oversize download: status %d, body %s; want 413 naming the limit", rec.Code, rec.Body)
+	}
+	if _, err := os.Stat(filepath.Join(s.wordbooksDir, "fetched.txt")); !os.IsNotExist(err) {
+		t.Errorf("refused fetches created a wordbook: %v", err)
+	}
+
+	s.importMaxBytes = 1 << 10
+	if rec := fetch(); rec.Code != http.StatusCreated {
+		t.Errorf("download within the limit: status %d, want 201: %s", rec.Code, rec.Body)
+	}
+}
@@ -68,7 +68,7 @@ function speedToPixelsPerSecond(level) {
 }
 
 async function fetchWordbooks() {
-  const res = await fetch("/api/wordbooks");
+  const res = await fetch("api/wordbooks");
   if (!res.ok) {
     throw new Error("Failed to load wordbook list.");
   }
@@ -77,16 +77,63 @@ async function fetchWordbooks() {
 }
 
 async function fetchWordbookWords(name) {
-  const res = await fetch(`/api/wordbooks/${encodeURIComponent(name)}`);
+  // The server sends one page of words at a time.
+  const words = [];
+  for (;;) {
+    const res = await fetch(`api/wordbooks/${encodeURIComponent(name)}?offset=${words.length}&limit=500`);
+    if (!res.ok) {
+      throw new Error("Failed to load wordbook words.");
+    }
+    const data = await res.json();
+    const page = data.words || [];
+    words.push(...page);
+    if (page.length === 0 || words.length >= data.total) {
+      return words;
+    }
+  }
+}
+
+function renderWordbookOptions(books) {
+  const selected = wordbookSelect.value;
+  wordbookSelect.innerHTML = "";
+  for (const name of books) {
+    const option = document.createElement("option");
+    option.value = name;
+    option.textContent = name;
+    wordbookSelect.appendChild(option);
+  }
+  if (books.includes(selected)) {
+    wordbookSelect.value = selected;
+  }
+}
+
+function watchWordbooks() {
+  if (typeof EventSource === "undefined") {
+    return;
+  }
+  const events = new EventSource("api/events");
+  events.addEventListener("wordbooks-changed", () => {
+    void fetchWordbooks()
+      .then((books) => {
+        if (books.length > 0) {
+          renderWordbookOptions(books);
+        }
+      })
+      .catch(() => {});
+  });
+}
+
+async function fetchAccents() {
+  const res = await fetch("api/accents");
   if (!res.ok) {
-    throw new Error("Failed to load wordbook words.");
+    throw new Error("Failed to load accent list.");
   }
   const data = await res.json();
-  return data.words || [];
+  return data.accents || [];
 }
 
 async function fetchSettings() {
-  const res = await fetch("/api/settings");
+  const res = await fetch("api/settings");
   if (!res.ok) {
     throw new Error("Failed to load settings.");
   }
@@ -94,7 +141,7 @@ async function fetchSettings() {
 }
 
 async function saveAccent(accent) {
-  const res = await fetch("/api/settings/accent", {
+  const res = await fetch("api/settings/accent", {
     method: "PUT",
     headers: {
       "Content-Type": "application/json",
@@ -108,7 +155,7 @@ async function saveAccent(accent) {
 }
 
 async function saveWordbook(wordbook) {
-  const res = await fetch("/api/settings/wordbook", {
+  const res = await fetch("api/settings/wordbook", {
     method: "PUT",
     headers: {
       "Content-Type": "application/json",
@@ -121,6 +168,34 @@ async function saveWordbook(wordbook) {
   return res.json();
 }
 
+async function saveSpeed(speed) {
+  const res = await fetch("api/settings/speed", {
+    method: "PUT",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ speed }),
+  });
+  if (!res.ok) {
+    throw new Error("Failed to save speed setting.");
+  }
+  return res.json();
+}
+
+async function saveSessionSize(sessionSize) {
+  const res = await fetch("api/settings/session-size", {
+    method: "PUT",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ sessionSize }),
+  });
+  if (!res.ok) {
+    throw new Error("Failed to save session size setting.");
+  }
+  return res.json();
+}
+
 function resetRuntimeState() {
   state.running = true;
   state.frozen = false;
@@ -576,17 +651,28 @@ async function init() {
     return;
   }
 
-  wordbookSelect.innerHTML = "";
-  for (const name of books) {
-    const option = document.createElement("option");
-    option.value = name;
-    option.textContent = name;
-    wordbookSelect.appendChild(option);
+  renderWordbookOptions(books);
+  watchWordbooks();
+
+  try {
+    const accents = await fetchAccents();
+    if (accents.length > 0) {
+      accentSelect.innerHTML = "";
+      for (const accent of accents) {
+        const option = document.createElement("option");
+        option.value = accent.code;
+        option.textContent = accent.label;
+        accentSelect.appendChild(option);
+      }
+    }
+  } catch (_err) {
+    // Keep the built-in accent options if the list is unavailable.
   }
 
   try {
     const settings = await fetchSettings();
-    if (settings && (settings.accent === "en-US" || settings.accent === "en-GB")) {
+    const accentCodes = Array.from(accentSelect.options, (option) => option.value);
+    if (settings && accentCodes.includes(settings.accent)) {
       accentSelect.value = settings.accent;
     }
     if (settings && typeof settings.wordbook === "string" && settings.wordbook.trim() !== "") {
@@ -598,6 +684,13 @@ async function init() {
         void saveWordbook(books[0]).catch(() => {});
       }
     }
+    if (settings && settings.speed > 0) {
+      speedRange.value = String(Math.round(settings.speed));
+      speedValue.textContent = speedRange.value;
+    }
+    if (settings && settings.sessionSize > 0) {
+      maxWordsInput.value = String(settings.sessionSize);
+    }
   } catch (_err) {
     // Keep default accent if settings are unavailable.
   }
@@ -613,6 +706,21 @@ async function init() {
     speedValue.textContent = speedRange.value;
   });
 
+  speedRange.addEventListener("change", () => {
+    void saveSpeed(Number(speedRange.value)).catch(() => {
+      setupError.textContent = "Failed to save speed preference.";
+    });
+  });
+
+  maxWordsInput.addEventListener("change", () => {
+    const sessionSize = parseMaxWordsLimit(maxWordsInput.value);
+    if (sessionSize > 0) {
+      void saveSessionSize(sessionSize).catch(() => {
+        setupError.textContent = "Failed to save session size preference.";
+      });
+    }
+  });
+
   accentSelect.addEventListener("change", () => {
     void saveAccent(accentSelect.value).catch(() => {
       setupError.textContent = "Failed to save accent preference.";